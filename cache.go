@@ -0,0 +1,371 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jonas747/dca"
+	"github.com/rs/zerolog/log"
+)
+
+const convertedSoundExtension = ".dca"
+
+// convertedSoundKey remembers the content hash of a sound so the source file
+// only has to be hashed again once it changes, along with the cache keys of
+// every conversion made from it
+type convertedSoundKey struct {
+	soundPath   string
+	size        int64
+	modTime     time.Time
+	contentHash string
+	keys        map[string]bool
+}
+
+var convertedSoundKeys map[string]convertedSoundKey
+var convertedSoundKeysLock sync.Mutex
+
+// Converted files are never rewritten under the same name, so their durations
+// are kept for as long as the bot runs
+var convertedSoundDurations map[string]time.Duration
+var convertedSoundDurationsLock sync.Mutex
+
+// initializeConvertedSoundCache keeps whatever was converted last time that
+// still matches a sound and its encode options, and deletes the rest
+func initializeConvertedSoundCache(allSounds []registeredAsset) {
+	convertedSoundKeys = make(map[string]convertedSoundKey)
+	convertedSoundDurations = make(map[string]time.Duration)
+	activeConversions = make(map[string]*conversion)
+
+	cacheDir, err := os.Stat(convertedSoundCachePath)
+	if os.IsNotExist(err) {
+		// Create the cache directory if it doesn't exist
+		if err := os.MkdirAll(convertedSoundCachePath, 0700); err != nil {
+			log.Fatal().
+				Err(err).
+				Msg("Failed to create sound cache directory")
+		}
+	} else if err != nil {
+		log.Fatal().
+			Err(err).
+			Str("convertedSoundCachePath", convertedSoundCachePath).
+			Msg("Error statting sound cache directory")
+		return
+	} else if !cacheDir.IsDir() {
+		log.Fatal().
+			Err(err).
+			Str("convertedSoundCachePath", convertedSoundCachePath).
+			Msg("Sound cache directory is a file")
+		return
+	}
+
+	pruneConvertedSoundCache(allSounds)
+}
+
+// pruneConvertedSoundCache deletes every conversion in the cache that isn't
+// the current conversion of one of the sounds, along with leftovers from
+// conversions that never finished. Anything else is left alone in case the
+// cache shares its directory.
+func pruneConvertedSoundCache(allSounds []registeredAsset) {
+	// Every guild volume in use gets its own conversion
+	guildVolumes := getConfiguredGuildVolumes()
+	liveFiles := make(map[string]bool)
+	for _, sound := range allSounds {
+		for _, guildVolume := range guildVolumes {
+			options := getEncodeOptions(sound.metadata, guildVolume)
+			convertedSoundPath, err := getConvertedSoundCachePath(sound.qualifiedName(), sound.path, options)
+			if err != nil {
+				log.Error().
+					Err(err).
+					Str("soundName", sound.qualifiedName()).
+					Msg("Failed to find converted sound")
+				break
+			}
+			liveFiles[filepath.Base(convertedSoundPath)] = true
+		}
+	}
+
+	cacheDir, err := ioutil.ReadDir(convertedSoundCachePath)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("convertedSoundCachePath", convertedSoundCachePath).
+			Msg("Error reading converted sound cache")
+		return
+	}
+
+	kept := 0
+	pruned := 0
+	for _, cachedFile := range cacheDir {
+		if !isConvertedSoundFile(cachedFile) {
+			continue
+		}
+		if liveFiles[cachedFile.Name()] {
+			kept++
+			continue
+		}
+		err := os.Remove(filepath.Join(convertedSoundCachePath, cachedFile.Name()))
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("cachedFile", cachedFile.Name()).
+				Msg("Failed to delete stale converted sound")
+			continue
+		}
+		pruned++
+	}
+
+	log.Info().
+		Int("kept", kept).
+		Int("pruned", pruned).
+		Msg("Pruned converted sound cache")
+}
+
+// isConvertedSoundFile reports whether a file in the cache is a conversion,
+// or the temporary file of one that was being written
+func isConvertedSoundFile(cachedFile os.FileInfo) bool {
+	name := cachedFile.Name()
+	if !cachedFile.Mode().IsRegular() {
+		return false
+	}
+	return strings.HasSuffix(name, convertedSoundExtension) ||
+		(strings.Contains(name, convertedSoundExtension+".") && strings.HasSuffix(name, ".tmp"))
+}
+
+func getContentHash(soundPath string) (string, error) {
+	soundFile, err := os.Open(soundPath)
+	if err != nil {
+		return "", err
+	}
+	defer soundFile.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, soundFile); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// getConvertedSoundKey hashes the source file's content together with the
+// options it's encoded with, so a change to either means a new conversion
+func getConvertedSoundKey(contentHash string, options *dca.EncodeOptions) (string, error) {
+	encodedOptions, err := json.Marshal(options)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	hash.Write([]byte(contentHash))
+	hash.Write(encodedOptions)
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func getConvertedSoundCachePath(soundName string, soundPath string, options *dca.EncodeOptions) (string, error) {
+	info, err := os.Stat(soundPath)
+	if err != nil {
+		return "", err
+	}
+
+	convertedSoundKeysLock.Lock()
+	remembered, found := convertedSoundKeys[soundName]
+	convertedSoundKeysLock.Unlock()
+
+	if !found ||
+		remembered.soundPath != soundPath ||
+		remembered.size != info.Size() ||
+		!remembered.modTime.Equal(info.ModTime()) {
+		contentHash, err := getContentHash(soundPath)
+		if err != nil {
+			return "", err
+		}
+		remembered = convertedSoundKey{soundPath, info.Size(), info.ModTime(), contentHash, make(map[string]bool)}
+	}
+
+	key, err := getConvertedSoundKey(remembered.contentHash, options)
+	if err != nil {
+		return "", err
+	}
+
+	convertedSoundKeysLock.Lock()
+	remembered.keys[key] = true
+	convertedSoundKeys[soundName] = remembered
+	convertedSoundKeysLock.Unlock()
+
+	return filepath.Join(convertedSoundCachePath, key+convertedSoundExtension), nil
+}
+
+// conversion is an encode in progress, which anyone else wanting the same
+// file waits on instead of starting their own
+type conversion struct {
+	done chan struct{}
+	err  error
+}
+
+var activeConversions map[string]*conversion
+var activeConversionsLock sync.Mutex
+
+// ensureConverted encodes a sound into the cache unless it's already there,
+// sharing a single encode between concurrent callers for the same file
+func ensureConverted(soundName string, soundPath string, encodedPath string, options *dca.EncodeOptions) error {
+	activeConversionsLock.Lock()
+	if active, found := activeConversions[encodedPath]; found {
+		activeConversionsLock.Unlock()
+		<-active.done
+		return active.err
+	}
+	// Checked under the lock so a conversion that just finished isn't redone
+	if isSoundCached(encodedPath) {
+		activeConversionsLock.Unlock()
+		return nil
+	}
+	active := &conversion{done: make(chan struct{})}
+	activeConversions[encodedPath] = active
+	activeConversionsLock.Unlock()
+
+	active.err = convertAndCache(soundName, soundPath, encodedPath, options)
+
+	activeConversionsLock.Lock()
+	delete(activeConversions, encodedPath)
+	activeConversionsLock.Unlock()
+	close(active.done)
+
+	return active.err
+}
+
+// convertAndCache encodes into a temporary file and renames it into place, so
+// the cache never has a partially written file under a real name
+func convertAndCache(soundName string, originalSoundPath string, encodedPath string, options *dca.EncodeOptions) error {
+	encodeSession, err := dca.EncodeFile(originalSoundPath, withMeasuredLoudness(originalSoundPath, options))
+	if err != nil {
+		return fmt.Errorf("starting encode: %w", err)
+	}
+	defer encodeSession.Cleanup()
+
+	output, err := ioutil.TempFile(filepath.Dir(encodedPath), filepath.Base(encodedPath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating temporary file: %w", err)
+	}
+	tempPath := output.Name()
+
+	_, err = io.Copy(output, encodeSession)
+	if err == nil {
+		// ffmpeg failing just looks like the end of the output to the copy
+		err = encodeSession.Error()
+		if err != nil {
+			log.Debug().
+				Str("soundName", soundName).
+				Str("ffmpegMessages", encodeSession.FFMPEGMessages()).
+				Msg("ffmpeg output from failed encode")
+		}
+	}
+	closeErr := output.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tempPath, encodedPath)
+	}
+	if err != nil {
+		if removeErr := os.Remove(tempPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			log.Error().
+				Err(removeErr).
+				Str("tempPath", tempPath).
+				Msg("Failed to clean up partially converted sound")
+		}
+		return fmt.Errorf("encoding %s: %w", originalSoundPath, err)
+	}
+
+	log.Debug().
+		Str("soundName", soundName).
+		Str("encodedPath", encodedPath).
+		Msg("Converted sound")
+	return nil
+}
+
+// evictConvertedSound deletes a sound's conversions once its source has
+// changed or gone away, unless another sound with identical content still
+// uses them
+func evictConvertedSound(soundName string) {
+	convertedSoundKeysLock.Lock()
+	defer convertedSoundKeysLock.Unlock()
+
+	remembered, found := convertedSoundKeys[soundName]
+	if !found {
+		return
+	}
+	delete(convertedSoundKeys, soundName)
+
+	for _, other := range convertedSoundKeys {
+		if other.contentHash == remembered.contentHash {
+			return
+		}
+	}
+
+	for key := range remembered.keys {
+		err := os.Remove(filepath.Join(convertedSoundCachePath, key+convertedSoundExtension))
+		if err != nil && !os.IsNotExist(err) {
+			log.Error().
+				Err(err).
+				Str("soundName", soundName).
+				Msg("Failed to evict converted sound")
+		}
+	}
+	log.Debug().
+		Str("soundName", soundName).
+		Msg("Evicted converted sound")
+}
+
+// getConvertedSoundDuration adds up the frames in a converted sound to find
+// how long it plays for
+func getConvertedSoundDuration(convertedSoundPath string) (time.Duration, error) {
+	convertedSoundDurationsLock.Lock()
+	duration, found := convertedSoundDurations[convertedSoundPath]
+	convertedSoundDurationsLock.Unlock()
+	if found {
+		return duration, nil
+	}
+
+	convertedFile, err := os.Open(convertedSoundPath)
+	if err != nil {
+		return 0, err
+	}
+	defer convertedFile.Close()
+
+	decoder := dca.NewDecoder(convertedFile)
+	for {
+		_, err := decoder.OpusFrame()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		duration += decoder.FrameDuration()
+	}
+
+	convertedSoundDurationsLock.Lock()
+	convertedSoundDurations[convertedSoundPath] = duration
+	convertedSoundDurationsLock.Unlock()
+	return duration, nil
+}
+
+func isSoundCached(convertedSoundPath string) bool {
+	var _, err = os.Stat(convertedSoundPath)
+	if os.IsNotExist(err) {
+		return false
+	} else if err != nil {
+		log.Error().
+			Err(err).
+			Str("convertedSoundPath", convertedSoundPath).
+			Msg("Error looking up converted sound")
+		return false
+	}
+	return true
+}
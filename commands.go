@@ -0,0 +1,834 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+)
+
+const maxAutocompleteChoices = 25
+
+// commandResponder sends a command's replies back to wherever the command
+// came from, either a text channel or a slash command interaction
+type commandResponder interface {
+	send(message *discordgo.MessageSend) (*discordgo.Message, error)
+}
+
+type channelResponder struct {
+	session   *discordgo.Session
+	channelID string
+}
+
+func (responder *channelResponder) send(message *discordgo.MessageSend) (*discordgo.Message, error) {
+	return responder.session.ChannelMessageSendComplex(responder.channelID, message)
+}
+
+// interactionResponder replies to a slash command. Queued sounds reply from
+// the queue's goroutine, possibly while the handler is still replying, so
+// whether the interaction has been responded to is guarded by a lock held
+// for the whole reply.
+type interactionResponder struct {
+	session     *discordgo.Session
+	interaction *discordgo.Interaction
+	lock        sync.Mutex
+	responded   bool
+}
+
+func (responder *interactionResponder) send(message *discordgo.MessageSend) (*discordgo.Message, error) {
+	responder.lock.Lock()
+	defer responder.lock.Unlock()
+
+	if responder.responded {
+		return responder.session.FollowupMessageCreate(responder.interaction, true, &discordgo.WebhookParams{
+			Content: message.Content,
+			Embeds:  message.Embeds,
+			Files:   message.Files,
+		})
+	}
+
+	err := responder.session.InteractionRespond(responder.interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: message.Content,
+			Embeds:  message.Embeds,
+			Files:   message.Files,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	responder.responded = true
+
+	// The initial response doesn't come back with the message it created
+	return responder.session.InteractionResponse(responder.interaction)
+}
+
+// finish acknowledges the interaction if the command didn't reply to it,
+// since Discord reports unanswered interactions as failed
+func (responder *interactionResponder) finish() {
+	responder.lock.Lock()
+	defer responder.lock.Unlock()
+
+	if responder.responded {
+		return
+	}
+
+	err := responder.session.InteractionRespond(responder.interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: "👍",
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("interactionID", responder.interaction.ID).
+			Msg("Error acknowledging interaction")
+	}
+	responder.responded = true
+}
+
+type commandRequest struct {
+	session   *discordgo.Session
+	responder commandResponder
+	name      string
+	// argument is normalized into an asset name, rawArgument is as typed
+	argument    string
+	rawArgument string
+	guildID     string
+	channelID   string
+	author      *discordgo.User
+}
+
+var commandHandlers = map[string]func(commandRequest){
+	"aku":   handlePlayCommand,
+	"akuh":  handleAudioHelpCommand,
+	"akuf":  handleSearchCommand,
+	"akus":  handleStickerCommand,
+	"akush": handleStickerHelpCommand,
+
+	"akuadmin": handleAdminCommand,
+}
+
+// Admin commands are limited to people who can manage the server
+var adminPermissions int64 = discordgo.PermissionManageServer
+
+var applicationCommands = []*discordgo.ApplicationCommand{
+	{
+		Name:        "aku",
+		Description: "Play a sound in your voice channel",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:         discordgo.ApplicationCommandOptionString,
+			Name:         "sound",
+			Description:  "Name of the sound",
+			Required:     true,
+			Autocomplete: true,
+		}},
+	},
+	{
+		Name:        "akuh",
+		Description: "List sound categories, or the sounds in a category",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:         discordgo.ApplicationCommandOptionString,
+			Name:         "category",
+			Description:  "Category to list",
+			Autocomplete: true,
+		}},
+	},
+	{
+		Name:        "akuf",
+		Description: "Search sounds by name, tag and category",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:        discordgo.ApplicationCommandOptionString,
+			Name:        "query",
+			Description: "What to search for",
+			Required:    true,
+		}},
+	},
+	{
+		Name:        "akus",
+		Description: "Post a sticker",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:         discordgo.ApplicationCommandOptionString,
+			Name:         "sticker",
+			Description:  "Name of the sticker",
+			Required:     true,
+			Autocomplete: true,
+		}},
+	},
+	{
+		Name:        "akush",
+		Description: "List sticker categories, or the stickers in a category",
+		Options: []*discordgo.ApplicationCommandOption{{
+			Type:         discordgo.ApplicationCommandOptionString,
+			Name:         "category",
+			Description:  "Category to list",
+			Autocomplete: true,
+		}},
+	},
+	{
+		Name:                     "akuadmin",
+		Description:              "Manage the bot",
+		DefaultMemberPermissions: &adminPermissions,
+		Options: []*discordgo.ApplicationCommandOption{
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "action",
+				Description: "What to do",
+				Required:    true,
+				Choices: []*discordgo.ApplicationCommandOptionChoice{
+					{Name: "Background encoding progress", Value: "encoding"},
+					{Name: "Guild volume", Value: "volume"},
+					{Name: "Playback limit in seconds", Value: "limit"},
+					{Name: "Command prefix", Value: "prefix"},
+					{Name: "Entry sounds on or off", Value: "entrysounds"},
+					{Name: "Channels commands are allowed in", Value: "channels"},
+					{Name: "A user's entry sound", Value: "entrysound"},
+					{Name: "A user's exit sound", Value: "exitsound"},
+					{Name: "When entry sounds play", Value: "entryrules"},
+				},
+			},
+			{
+				Type:        discordgo.ApplicationCommandOptionString,
+				Name:        "value",
+				Description: "New value for the setting",
+			},
+		},
+	},
+}
+
+func registerApplicationCommands(session *discordgo.Session) {
+	_, err := session.ApplicationCommandBulkOverwrite(session.State.User.ID, "", applicationCommands)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to register application commands")
+		return
+	}
+
+	log.Info().
+		Int("commands", len(applicationCommands)).
+		Msg("Registered application commands")
+}
+
+func dispatchCommand(request commandRequest) {
+	handler, found := commandHandlers[request.name]
+	if !found {
+		return
+	}
+	// Admin commands work everywhere so a guild can't lock itself out
+	if request.name != "akuadmin" && !isChannelAllowed(request.guildID, request.channelID) {
+		return
+	}
+
+	defer func() {
+		err := recover()
+		if err != nil {
+			log.Error().
+				Str("command", request.name).
+				Msgf("Panic in processing command: %v", err)
+			return
+		}
+	}()
+
+	log.Info().
+		Str("command", request.name).
+		Str("argument", request.argument).
+		Str("authorUsername", getUniqueUsername(request.author)).
+		Msg("Processing command")
+
+	handler(request)
+}
+
+func replyText(request commandRequest, content string) {
+	_, err := request.responder.send(&discordgo.MessageSend{Content: content})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("channelID", request.channelID).
+			Msg("Error replying to command")
+	}
+}
+
+func handlePlayCommand(request commandRequest) {
+	switch request.argument {
+	case "queue":
+		sendQueue(request.responder, request.guildID)
+		return
+	case "stop", "skip":
+		handleStopCommand(request)
+		return
+	}
+
+	// Validate we can send
+	var authorVoiceState, authorVoiceStateFound = getUserVoiceState(request.session, request.guildID, request.author.ID)
+	if !authorVoiceStateFound {
+		return
+	}
+
+	var asset registeredAsset
+	var assetExists bool
+	if words := strings.Fields(request.rawArgument); len(words) > 0 && words[0] == "random" {
+		asset, assetExists = resolveRandomSound(request, strings.Join(words[1:], " "))
+	} else {
+		asset, assetExists = resolveSound(request)
+	}
+	if !assetExists {
+		return
+	}
+	err := enqueueSound(request.session, soundRequest{asset, authorVoiceState, request.responder})
+	if err == errQueueFull {
+		replyText(request, "The queue is full, try again in a bit")
+	}
+}
+
+// handleStopCommand ends the sound playing in the guild, after which the
+// queue moves on to the next one
+func handleStopCommand(request commandRequest) {
+	if !canControlPlayback(request) {
+		replyText(request, "You have to be in the voice channel to do that")
+		return
+	}
+	if !stopActiveStream(request.guildID) {
+		replyText(request, "Nothing is playing")
+		return
+	}
+
+	log.Info().
+		Str("guildID", request.guildID).
+		Str("authorUsername", getUniqueUsername(request.author)).
+		Msg("Stopped sound")
+}
+
+// canControlPlayback allows anyone listening to the bot, or anyone with one
+// of the configured playback control roles
+func canControlPlayback(request commandRequest) bool {
+	playbackControlRoles := getConfig().PlaybackControlRoles
+	authorVoiceState, found := getUserVoiceState(request.session, request.guildID, request.author.ID)
+	connectedChannel := getConnectedChannel(request.guildID)
+	if found && connectedChannel != "" && authorVoiceState.channel == connectedChannel {
+		return true
+	}
+	if len(playbackControlRoles) == 0 {
+		return false
+	}
+
+	member, err := request.session.State.Member(request.guildID, request.author.ID)
+	if err != nil {
+		member, err = request.session.GuildMember(request.guildID, request.author.ID)
+	}
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("guildID", request.guildID).
+			Str("userID", request.author.ID).
+			Msg("Failed to get member roles")
+		return false
+	}
+
+	for _, role := range member.Roles {
+		if containsString(playbackControlRoles, role) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSound looks up the requested sound, falling back to a fuzzy match
+// and letting the user know when it can't pick one
+func resolveSound(request commandRequest) (registeredAsset, bool) {
+	if asset, assetExists := audioAssets.Lookup(request.argument); assetExists {
+		return asset, true
+	}
+
+	// The name exists, but in more than one category
+	if qualifiedNames := audioAssets.Qualify(request.argument); len(qualifiedNames) > 1 {
+		replyText(request, fmt.Sprintf("There's more than one %s, did you mean: %s",
+			request.argument, strings.Join(qualifiedNames, ", ")))
+		return registeredAsset{}, false
+	}
+
+	matches := rankFuzzyMatches(request.argument, audioAssets.Names())
+
+	if soundName, found := pickFuzzyMatch(matches); found {
+		log.Info().
+			Str("argument", request.argument).
+			Str("soundName", soundName).
+			Msg("Fuzzy matched sound")
+		return audioAssets.Lookup(soundName)
+	}
+
+	if len(matches) == 0 {
+		replyText(request, fmt.Sprintf("No sound called %s", request.argument))
+	} else {
+		replyText(request, fmt.Sprintf("Did you mean: %s", strings.Join(getSuggestions(matches), ", ")))
+	}
+	return registeredAsset{}, false
+}
+
+// resolveRandomSound picks a random sound and says which one it picked
+func resolveRandomSound(request commandRequest, category string) (registeredAsset, bool) {
+	category = getAssetFromCommand(category)
+	asset, found := pickRandomSound(request.guildID, category)
+	if !found {
+		replyText(request, fmt.Sprintf("No sounds in %s", category))
+		return registeredAsset{}, false
+	}
+
+	name := asset.name
+	if audioAssets.Collides(name) {
+		name = asset.qualifiedName()
+	}
+	replyText(request, "🎲 "+name)
+	return asset, true
+}
+
+func handleAudioHelpCommand(request commandRequest) {
+	if words := strings.Fields(request.rawArgument); len(words) > 0 && words[0] == "search" {
+		sendSearchResults(request, strings.Join(words[1:], " "))
+		return
+	}
+	sendAudioHelp(request.session, request.responder, request.argument)
+}
+
+func handleSearchCommand(request commandRequest) {
+	sendSearchResults(request, request.rawArgument)
+}
+
+func sendSearchResults(request commandRequest, query string) {
+	query = getAssetFromCommand(query)
+	if query == "" {
+		replyText(request, "Search for what?")
+		return
+	}
+
+	helpPage, err := initializeSearchHelpPage("audio", audioAssets, query)
+	if err != nil {
+		replyText(request, fmt.Sprintf("No sounds matching %s", query))
+		return
+	}
+	sendHelp(request.session, request.responder, helpPage)
+}
+
+func handleStickerCommand(request commandRequest) {
+	var sticker, stickerExists = stickerAssets.Lookup(request.argument)
+	if !stickerExists {
+		return
+	}
+	sendSticker(request.responder, request.argument, sticker.path)
+}
+
+func handleStickerHelpCommand(request commandRequest) {
+	sendStickerHelp(request.session, request.responder, request.argument)
+}
+
+func isAdmin(request commandRequest) bool {
+	permissions, err := request.session.UserChannelPermissions(request.author.ID, request.channelID)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("userID", request.author.ID).
+			Str("channelID", request.channelID).
+			Msg("Failed to get permissions")
+		return false
+	}
+	return permissions&adminPermissions != 0
+}
+
+func handleAdminCommand(request commandRequest) {
+	if !isAdmin(request) {
+		replyText(request, "Only server managers can do that")
+		return
+	}
+
+	action := strings.Fields(request.rawArgument)
+	if len(action) == 0 {
+		action = []string{""}
+	}
+
+	switch action[0] {
+	case "encoding":
+		replyText(request, backgroundEncoder.describeProgress())
+	case "volume":
+		handleVolumeCommand(request, action[1:])
+	case "limit":
+		handlePlaybackLimitCommand(request, action[1:])
+	case "prefix":
+		handlePrefixCommand(request, action[1:])
+	case "entrysounds":
+		handleEntrySoundsCommand(request, action[1:])
+	case "channels":
+		handleChannelsCommand(request, action[1:])
+	case "entrysound":
+		handleUserSoundCommand(request, action[1:], entrySoundsBucket, "entry")
+	case "exitsound":
+		handleUserSoundCommand(request, action[1:], exitSoundsBucket, "exit")
+	case "entryrules":
+		handleEntryRulesCommand(request, action[1:])
+	default:
+		replyText(request, "Admin commands: encoding, volume [percent], limit [seconds], prefix [prefix], "+
+			"entrysounds [on|off], channels [add|remove|clear] [channel], entrysound <user> [sound|clear], exitsound <user> [sound|clear], "+
+			"entryrules [user] [cooldown|moves|exits|quiet|timezone|pick] [value]")
+	}
+}
+
+func handleVolumeCommand(request commandRequest, arguments []string) {
+	if len(arguments) == 0 {
+		replyText(request, fmt.Sprintf("Volume is %d%%", getGuildVolume(request.guildID)))
+		return
+	}
+
+	volume, err := strconv.Atoi(strings.TrimSuffix(arguments[0], "%"))
+	if err != nil || volume < minGuildVolume || volume > maxGuildVolume {
+		replyText(request, fmt.Sprintf("Volume has to be a percentage from %d to %d", minGuildVolume, maxGuildVolume))
+		return
+	}
+
+	if err := setGuildVolume(request.guildID, volume); err != nil {
+		log.Error().
+			Err(err).
+			Str("guildID", request.guildID).
+			Msg("Failed to save guild volume")
+		replyText(request, "Couldn't save the volume")
+		return
+	}
+	replyText(request, fmt.Sprintf("Volume set to %d%%", volume))
+}
+
+func handlePlaybackLimitCommand(request commandRequest, arguments []string) {
+	if len(arguments) == 0 {
+		replyText(request, fmt.Sprintf("Sounds are cut off after %s", getGuildPlaybackLimit(request.guildID)))
+		return
+	}
+
+	limitSeconds, err := strconv.Atoi(strings.TrimSuffix(arguments[0], "s"))
+	if err != nil || limitSeconds < 0 || limitSeconds > maxPlaybackLimitSeconds {
+		replyText(request, fmt.Sprintf("The limit has to be a number of seconds up to %d, or 0 for the default", maxPlaybackLimitSeconds))
+		return
+	}
+
+	if err := setGuildPlaybackLimit(request.guildID, limitSeconds); err != nil {
+		log.Error().
+			Err(err).
+			Str("guildID", request.guildID).
+			Msg("Failed to save playback limit")
+		replyText(request, "Couldn't save the limit")
+		return
+	}
+	replyText(request, fmt.Sprintf("Sounds are cut off after %s", getGuildPlaybackLimit(request.guildID)))
+}
+
+func handlePrefixCommand(request commandRequest, arguments []string) {
+	if len(arguments) == 0 {
+		replyText(request, fmt.Sprintf("Text commands start with %s", getGuildPrefix(request.guildID)))
+		return
+	}
+
+	prefix := arguments[0]
+	if prefix == getConfig().Prefix {
+		// Follow the config if it changes later
+		prefix = ""
+	}
+	if err := setGuildPrefix(request.guildID, prefix); err != nil {
+		log.Error().
+			Err(err).
+			Str("guildID", request.guildID).
+			Msg("Failed to save prefix")
+		replyText(request, "Couldn't save the prefix")
+		return
+	}
+	replyText(request, fmt.Sprintf("Text commands start with %s", getGuildPrefix(request.guildID)))
+}
+
+func handleEntrySoundsCommand(request commandRequest, arguments []string) {
+	if len(arguments) == 0 {
+		if areEntrySoundsEnabled(request.guildID) {
+			replyText(request, "Entry sounds are on")
+		} else {
+			replyText(request, "Entry sounds are off")
+		}
+		return
+	}
+
+	var enabled bool
+	switch arguments[0] {
+	case "on":
+		enabled = true
+	case "off":
+		enabled = false
+	default:
+		replyText(request, "Entry sounds can be on or off")
+		return
+	}
+
+	if err := setEntrySoundsEnabled(request.guildID, enabled); err != nil {
+		log.Error().
+			Err(err).
+			Str("guildID", request.guildID).
+			Msg("Failed to save entry sounds setting")
+		replyText(request, "Couldn't save the setting")
+		return
+	}
+	replyText(request, fmt.Sprintf("Entry sounds are %s", arguments[0]))
+}
+
+// getChannelFromArgument reads a channel mention or ID, defaulting to the
+// channel the command was sent in
+func getChannelFromArgument(request commandRequest, arguments []string) string {
+	if len(arguments) == 0 {
+		return request.channelID
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(arguments[0], "<#"), ">")
+}
+
+func handleChannelsCommand(request commandRequest, arguments []string) {
+	action := ""
+	if len(arguments) > 0 {
+		action = arguments[0]
+		arguments = arguments[1:]
+	}
+
+	var err error
+	switch action {
+	case "":
+	case "add":
+		err = setChannelAllowed(request.guildID, getChannelFromArgument(request, arguments), true)
+	case "remove":
+		err = setChannelAllowed(request.guildID, getChannelFromArgument(request, arguments), false)
+	case "clear":
+		err = clearAllowedChannels(request.guildID)
+	default:
+		replyText(request, "Channels can be added, removed or cleared")
+		return
+	}
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("guildID", request.guildID).
+			Msg("Failed to save allowed channels")
+		replyText(request, "Couldn't save the channels")
+		return
+	}
+
+	allowedChannels := getGuildSettings(request.guildID).AllowedChannels
+	if len(allowedChannels) == 0 {
+		replyText(request, "Commands are allowed in every channel")
+		return
+	}
+	mentions := make([]string, len(allowedChannels))
+	for i, channelID := range allowedChannels {
+		mentions[i] = "<#" + channelID + ">"
+	}
+	replyText(request, "Commands are allowed in "+strings.Join(mentions, ", "))
+}
+
+// getUserFromArgument reads a user mention or ID
+func getUserFromArgument(argument string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(argument, "<@"), "!"), ">")
+}
+
+// handleUserSoundCommand shows or sets a user's entry or exit sound in the
+// current guild, depending on the bucket. It can be a sound or a category to
+// pick from. Server managers only have a say over their own server, so what
+// they set never applies anywhere else.
+func handleUserSoundCommand(request commandRequest, arguments []string, soundsBucket []byte, kind string) {
+	if len(arguments) == 0 {
+		replyText(request, fmt.Sprintf("Whose %s sound?", kind))
+		return
+	}
+	userID := getUserFromArgument(arguments[0])
+	arguments = arguments[1:]
+	key := getGuildUserKey(request.guildID, userID)
+
+	if len(arguments) == 0 {
+		soundName, found := getMappedSound(soundsBucket, key)
+		if !found {
+			replyText(request, fmt.Sprintf("<@%s> doesn't have an %s sound set here", userID, kind))
+			return
+		}
+		replyText(request, fmt.Sprintf("<@%s>'s %s sound here is %s", userID, kind, soundName))
+		return
+	}
+
+	soundName := getAssetFromCommand(strings.Join(arguments, " "))
+	if soundName == "clear" {
+		soundName = ""
+	} else if _, found := audioAssets.ListCategory(soundName); found {
+		// Every sound in the category gets picked from
+	} else if sound, found := audioAssets.Lookup(soundName); found {
+		soundName = sound.qualifiedName()
+	} else {
+		replyText(request, fmt.Sprintf("No sound or category called %s", soundName))
+		return
+	}
+
+	if err := setMappedSound(soundsBucket, key, soundName); err != nil {
+		log.Error().
+			Err(err).
+			Str("userID", userID).
+			Str("kind", kind).
+			Msg("Failed to save user's sound")
+		replyText(request, fmt.Sprintf("Couldn't save the %s sound", kind))
+		return
+	}
+	if soundName == "" {
+		replyText(request, fmt.Sprintf("Cleared <@%s>'s %s sound here", userID, kind))
+	} else {
+		replyText(request, fmt.Sprintf("<@%s>'s %s sound here is now %s", userID, kind, soundName))
+	}
+}
+
+// handleEntryRulesCommand shows or changes when entry sounds play in the
+// guild, for everyone or for one user if they're mentioned first
+func handleEntryRulesCommand(request commandRequest, arguments []string) {
+	userID := ""
+	if len(arguments) > 0 && strings.HasPrefix(arguments[0], "<@") {
+		userID = getUserFromArgument(arguments[0])
+		arguments = arguments[1:]
+	}
+
+	if len(arguments) > 0 {
+		rule := arguments[0]
+		value := strings.Join(arguments[1:], "")
+
+		var ruleErr error
+		update := func(rules *entrySoundRules) {
+			ruleErr = setEntrySoundRule(rules, rule, value)
+		}
+		var err error
+		if userID != "" {
+			err = updateUserEntrySoundRules(request.guildID, userID, update)
+		} else {
+			err = updateGuildSettings(request.guildID, func(settings *guildSettings) {
+				update(&settings.EntrySoundRules)
+			})
+		}
+		if ruleErr != nil {
+			replyText(request, ruleErr.Error())
+			return
+		}
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("guildID", request.guildID).
+				Str("userID", userID).
+				Msg("Failed to save entry sound rules")
+			replyText(request, "Couldn't save the rules")
+			return
+		}
+	}
+
+	if userID != "" {
+		replyText(request, fmt.Sprintf("Entry sounds for <@%s>: %s",
+			userID, getEntrySoundRules(request.guildID, userID).describe()))
+	} else {
+		replyText(request, "Entry sounds: "+getConfig().EntrySoundRules.
+			overriddenBy(getGuildSettings(request.guildID).EntrySoundRules).describe())
+	}
+}
+
+func onInteractionCreate(session *discordgo.Session, event *discordgo.InteractionCreate) {
+	switch event.Type {
+	case discordgo.InteractionApplicationCommand:
+		data := event.ApplicationCommandData()
+		// Options are joined the way they'd be typed after a text command
+		optionValues := make([]string, 0, len(data.Options))
+		for _, option := range data.Options {
+			optionValues = append(optionValues, fmt.Sprint(option.Value))
+		}
+		rawArgument := strings.Join(optionValues, " ")
+
+		author := event.User
+		if event.Member != nil {
+			author = event.Member.User
+		}
+
+		responder := &interactionResponder{session: session, interaction: event.Interaction}
+		dispatchCommand(commandRequest{
+			session:     session,
+			responder:   responder,
+			name:        data.Name,
+			argument:    getAssetFromCommand(rawArgument),
+			rawArgument: rawArgument,
+			guildID:     event.GuildID,
+			channelID:   event.ChannelID,
+			author:      author,
+		})
+		responder.finish()
+
+	case discordgo.InteractionApplicationCommandAutocomplete:
+		respondAutocomplete(session, event.Interaction)
+	}
+}
+
+func getAutocompleteCandidates(commandName string) []string {
+	switch commandName {
+	case "aku":
+		return audioAssets.Names()
+	case "akuh":
+		return audioAssets.Categories()
+	case "akus":
+		return stickerAssets.Names()
+	case "akush":
+		return stickerAssets.Categories()
+	}
+	return nil
+}
+
+// getAutocompleteChoices returns the candidates containing the query, with
+// the ones starting with it first
+func getAutocompleteChoices(candidates []string, query string) []*discordgo.ApplicationCommandOptionChoice {
+	query = strings.ToLower(getAssetFromCommand(query))
+
+	prefixMatches := make([]string, 0)
+	substringMatches := make([]string, 0)
+	for _, candidate := range candidates {
+		lowerCandidate := strings.ToLower(candidate)
+		if strings.HasPrefix(lowerCandidate, query) {
+			prefixMatches = append(prefixMatches, candidate)
+		} else if strings.Contains(lowerCandidate, query) {
+			substringMatches = append(substringMatches, candidate)
+		}
+	}
+	sort.Strings(prefixMatches)
+	sort.Strings(substringMatches)
+
+	choices := make([]*discordgo.ApplicationCommandOptionChoice, 0, maxAutocompleteChoices)
+	for _, match := range append(prefixMatches, substringMatches...) {
+		if len(choices) == maxAutocompleteChoices {
+			break
+		}
+		choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: match, Value: match})
+	}
+	return choices
+}
+
+func respondAutocomplete(session *discordgo.Session, interaction *discordgo.Interaction) {
+	data := interaction.ApplicationCommandData()
+
+	query := ""
+	for _, option := range data.Options {
+		if option.Focused {
+			query = option.StringValue()
+		}
+	}
+
+	err := session.InteractionRespond(interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{
+			Choices: getAutocompleteChoices(getAutocompleteCandidates(data.Name), query),
+		},
+	})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("command", data.Name).
+			Msg("Error responding to autocomplete")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+const defaultConfigPath = "/go-aku/config.yaml"
+
+// botConfig is everything that can be set from the config file, the
+// environment or flags, which take precedence in that order over the defaults
+type botConfig struct {
+	Token string `yaml:"token"`
+
+	RootDir     string `yaml:"rootDir"`
+	CachePath   string `yaml:"cachePath"`
+	AudioPath   string `yaml:"audioPath"`
+	StickerPath string `yaml:"stickerPath"`
+
+	Prefix         string `yaml:"prefix"`
+	ResultsPerPage int    `yaml:"resultsPerPage"`
+	LogLevel       string `yaml:"logLevel"`
+
+	MaxQueueDepth           int      `yaml:"maxQueueDepth"`
+	VoiceIdleTimeoutSeconds int      `yaml:"voiceIdleTimeoutSeconds"`
+	EncodeWorkers           int      `yaml:"encodeWorkers"`
+	RandomRepeatWindow      int      `yaml:"randomRepeatWindow"`
+	PlaybackLimitSeconds    int      `yaml:"playbackLimitSeconds"`
+	PlaybackControlRoles    []string `yaml:"playbackControlRoles"`
+
+	// Only settable from the file, and overridden per guild and per user
+	EntrySoundRules entrySoundRules `yaml:"entrySoundRules"`
+}
+
+func getDefaultConfig() *botConfig {
+	return &botConfig{
+		RootDir:                 "/go-aku",
+		Prefix:                  "!",
+		ResultsPerPage:          10,
+		LogLevel:                "info",
+		MaxQueueDepth:           defaultMaxQueueDepth,
+		VoiceIdleTimeoutSeconds: defaultVoiceIdleTimeoutSeconds,
+		EncodeWorkers:           defaultEncodeWorkers,
+		RandomRepeatWindow:      defaultRandomRepeatWindow,
+		PlaybackLimitSeconds:    defaultPlaybackLimitSeconds,
+		PlaybackControlRoles:    []string{},
+	}
+}
+
+// configSetting ties a config field to its environment variable and flag.
+// Settings that aren't reloadable are only read at startup, since changing
+// them would mean restarting whatever uses them.
+type configSetting struct {
+	flag       string
+	env        string
+	usage      string
+	reloadable bool
+	field      func(*botConfig) interface{}
+}
+
+var configSettings = []configSetting{
+	{"token", "DISCORD_TOKEN", "Discord bot token", false, func(config *botConfig) interface{} { return &config.Token }},
+	{"root-dir", "AKU_ROOT_DIR", "Directory holding the bot's assets and state", false, func(config *botConfig) interface{} { return &config.RootDir }},
+	{"cache-path", "AKU_CACHE_PATH", "Directory for converted sounds (default <root-dir>/cache)", false, func(config *botConfig) interface{} { return &config.CachePath }},
+	{"audio-path", "AKU_AUDIO_PATH", "Directory of sound categories (default <root-dir>/audio)", false, func(config *botConfig) interface{} { return &config.AudioPath }},
+	{"sticker-path", "AKU_STICKER_PATH", "Directory of sticker categories (default <root-dir>/stickers)", false, func(config *botConfig) interface{} { return &config.StickerPath }},
+	{"prefix", "AKU_PREFIX", "Prefix for text commands", true, func(config *botConfig) interface{} { return &config.Prefix }},
+	{"results-per-page", "AKU_RESULTS_PER_PAGE", "Entries on each help page", true, func(config *botConfig) interface{} { return &config.ResultsPerPage }},
+	{"log-level", "AKU_LOG_LEVEL", "Minimum level to log", true, func(config *botConfig) interface{} { return &config.LogLevel }},
+	{"max-queue-depth", "AKU_MAX_QUEUE_DEPTH", "Sounds that can wait in each guild's queue", true, func(config *botConfig) interface{} { return &config.MaxQueueDepth }},
+	{"voice-idle-timeout-seconds", "AKU_VOICE_IDLE_TIMEOUT_SECONDS", "Seconds to stay in voice after the last sound", true, func(config *botConfig) interface{} { return &config.VoiceIdleTimeoutSeconds }},
+	{"encode-workers", "AKU_ENCODE_WORKERS", "Sounds to encode at once in the background", false, func(config *botConfig) interface{} { return &config.EncodeWorkers }},
+	{"random-repeat-window", "AKU_RANDOM_REPEAT_WINDOW", "Recent random picks to avoid repeating", true, func(config *botConfig) interface{} { return &config.RandomRepeatWindow }},
+	{"playback-limit-seconds", "AKU_PLAYBACK_LIMIT_SECONDS", "Seconds to play sounds for before cutting them off", true, func(config *botConfig) interface{} { return &config.PlaybackLimitSeconds }},
+	{"playback-control-roles", "AKU_PLAYBACK_CONTROL_ROLES", "Comma separated IDs of roles that can always stop sounds", true, func(config *botConfig) interface{} { return &config.PlaybackControlRoles }},
+}
+
+var currentConfig *botConfig
+var currentConfigLock sync.RWMutex
+
+// Flags are parsed once at startup, and applied again on every reload so
+// they keep precedence over the file
+var configPath string
+var configFlags = make(map[string]string)
+
+// getConfig returns the config in effect. It's replaced rather than changed
+// on reload, so it's safe to hold on to.
+func getConfig() *botConfig {
+	currentConfigLock.RLock()
+	defer currentConfigLock.RUnlock()
+
+	return currentConfig
+}
+
+// configFlag records a flag's value to be applied on top of the file and the
+// environment
+type configFlag struct {
+	name string
+}
+
+func (configFlag configFlag) String() string {
+	return configFlags[configFlag.name]
+}
+
+func (configFlag configFlag) Set(value string) error {
+	configFlags[configFlag.name] = value
+	return nil
+}
+
+func parseConfigFlags() {
+	flag.StringVar(&configPath, "config", os.Getenv("AKU_CONFIG"), "Config file (default "+defaultConfigPath+")")
+	for _, setting := range configSettings {
+		flag.Var(configFlag{setting.flag}, setting.flag, fmt.Sprintf("%s (env %s)", setting.usage, setting.env))
+	}
+	flag.Parse()
+}
+
+func setConfigValue(field interface{}, rawValue string) error {
+	switch field := field.(type) {
+	case *string:
+		*field = rawValue
+	case *int:
+		value, err := strconv.Atoi(rawValue)
+		if err != nil {
+			return err
+		}
+		*field = value
+	case *[]string:
+		values := make([]string, 0)
+		for _, value := range strings.Split(rawValue, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+		*field = values
+	}
+	return nil
+}
+
+func formatConfigValue(field interface{}) string {
+	switch field := field.(type) {
+	case *string:
+		return *field
+	case *int:
+		return strconv.Itoa(*field)
+	case *[]string:
+		return strings.Join(*field, ",")
+	}
+	return ""
+}
+
+func copyConfigValue(destination interface{}, source interface{}) {
+	switch destination := destination.(type) {
+	case *string:
+		*destination = *source.(*string)
+	case *int:
+		*destination = *source.(*int)
+	case *[]string:
+		*destination = *source.(*[]string)
+	}
+}
+
+// loadConfig builds the config from the defaults, then the config file, then
+// the environment, then flags
+func loadConfig() (*botConfig, error) {
+	config := getDefaultConfig()
+
+	path := configPath
+	if path == "" {
+		path = defaultConfigPath
+	}
+	configFile, err := os.Open(path)
+	if os.IsNotExist(err) && configPath == "" {
+		// The default config file is optional
+	} else if err != nil {
+		return nil, err
+	} else {
+		defer configFile.Close()
+		decoder := yaml.NewDecoder(configFile)
+		decoder.KnownFields(true)
+		// An empty file decodes as EOF
+		if err := decoder.Decode(config); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	for _, setting := range configSettings {
+		if rawValue, found := os.LookupEnv(setting.env); found {
+			if err := setConfigValue(setting.field(config), rawValue); err != nil {
+				return nil, fmt.Errorf("%s: %w", setting.env, err)
+			}
+		}
+	}
+	for _, setting := range configSettings {
+		if rawValue, found := configFlags[setting.flag]; found {
+			if err := setConfigValue(setting.field(config), rawValue); err != nil {
+				return nil, fmt.Errorf("-%s: %w", setting.flag, err)
+			}
+		}
+	}
+
+	// Paths not set on their own live under the root
+	if config.CachePath == "" {
+		config.CachePath = filepath.Join(config.RootDir, "cache")
+	}
+	if config.AudioPath == "" {
+		config.AudioPath = filepath.Join(config.RootDir, "audio")
+	}
+	if config.StickerPath == "" {
+		config.StickerPath = filepath.Join(config.RootDir, "stickers")
+	}
+
+	return config, validateConfig(config)
+}
+
+func validateConfig(config *botConfig) error {
+	switch {
+	case config.Token == "":
+		return errors.New("No token, set DISCORD_TOKEN")
+	case config.RootDir == "":
+		return errors.New("rootDir can't be empty")
+	case config.Prefix == "" || strings.ContainsAny(config.Prefix, " \t\n"):
+		return errors.New("prefix has to be non-empty without spaces")
+	case config.ResultsPerPage < 1:
+		return errors.New("resultsPerPage has to be at least 1")
+	case config.MaxQueueDepth < 1:
+		return errors.New("maxQueueDepth has to be at least 1")
+	case config.VoiceIdleTimeoutSeconds < 0:
+		return errors.New("voiceIdleTimeoutSeconds can't be negative")
+	case config.EncodeWorkers < 1:
+		return errors.New("encodeWorkers has to be at least 1")
+	case config.RandomRepeatWindow < 0:
+		return errors.New("randomRepeatWindow can't be negative")
+	case config.PlaybackLimitSeconds < 1 || config.PlaybackLimitSeconds > maxPlaybackLimitSeconds:
+		return fmt.Errorf("playbackLimitSeconds has to be from 1 to %d", maxPlaybackLimitSeconds)
+	}
+	for _, path := range []string{config.RootDir, config.AudioPath, config.StickerPath} {
+		if isPathWithin(path, config.CachePath) {
+			return fmt.Errorf("cachePath can't hold %s, since stale files in it are deleted", path)
+		}
+	}
+	if _, err := zerolog.ParseLevel(config.LogLevel); err != nil {
+		return fmt.Errorf("logLevel: %w", err)
+	}
+	if quietHours := config.EntrySoundRules.QuietHours; quietHours != nil && *quietHours != "" {
+		if _, _, err := parseQuietHours(*quietHours); err != nil {
+			return fmt.Errorf("entrySoundRules: %w", err)
+		}
+	}
+	if timezone := config.EntrySoundRules.Timezone; timezone != nil {
+		if _, err := time.LoadLocation(*timezone); err != nil {
+			return fmt.Errorf("entrySoundRules: %w", err)
+		}
+	}
+	if pick := config.EntrySoundRules.Pick; pick != nil && *pick != randomPick && *pick != roundRobinPick {
+		return errors.New("entrySoundRules: pick has to be random or roundrobin")
+	}
+	if cooldown := config.EntrySoundRules.CooldownSeconds; cooldown != nil && *cooldown < 0 {
+		return errors.New("entrySoundRules: cooldownSeconds can't be negative")
+	}
+	return nil
+}
+
+// isPathWithin reports whether path is parent or somewhere under it
+func isPathWithin(path string, parent string) bool {
+	relativePath, err := filepath.Rel(filepath.Clean(parent), filepath.Clean(path))
+	if err != nil {
+		return false
+	}
+	return relativePath == "." || (relativePath != ".." && !strings.HasPrefix(relativePath, ".."+string(filepath.Separator)))
+}
+
+func applyConfig(config *botConfig) {
+	currentConfigLock.Lock()
+	currentConfig = config
+	currentConfigLock.Unlock()
+
+	// Already validated
+	level, _ := zerolog.ParseLevel(config.LogLevel)
+	zerolog.SetGlobalLevel(level)
+}
+
+// reloadConfig reads the config again, keeping the running config if the new
+// one isn't valid. Settings that can't be reloaded keep their old values.
+func reloadConfig() {
+	config, err := loadConfig()
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Invalid config, keeping the old one")
+		return
+	}
+
+	oldConfig := getConfig()
+	for _, setting := range configSettings {
+		if setting.reloadable {
+			continue
+		}
+		oldValue := setting.field(oldConfig)
+		if formatConfigValue(setting.field(config)) != formatConfigValue(oldValue) {
+			log.Warn().
+				Str("setting", setting.flag).
+				Msg("Setting can't be reloaded, restart to change it")
+		}
+		copyConfigValue(setting.field(config), oldValue)
+	}
+
+	applyConfig(config)
+	log.Info().Msg("Reloaded config")
+}
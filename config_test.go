@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   string
+		env    map[string]string
+		flags  map[string]string
+		check  func(*botConfig) interface{}
+		want   interface{}
+		hasErr bool
+	}{
+		{
+			name:  "default",
+			file:  "token: abc\n",
+			check: func(config *botConfig) interface{} { return config.ResultsPerPage },
+			want:  10,
+		},
+		{
+			name:  "file over default",
+			file:  "token: abc\nprefix: \"?\"\n",
+			check: func(config *botConfig) interface{} { return config.Prefix },
+			want:  "?",
+		},
+		{
+			name:  "env over file",
+			file:  "token: abc\nprefix: \"?\"\n",
+			env:   map[string]string{"AKU_PREFIX": "$"},
+			check: func(config *botConfig) interface{} { return config.Prefix },
+			want:  "$",
+		},
+		{
+			name:  "flag over env",
+			file:  "token: abc\nprefix: \"?\"\n",
+			env:   map[string]string{"AKU_PREFIX": "$"},
+			flags: map[string]string{"prefix": "%"},
+			check: func(config *botConfig) interface{} { return config.Prefix },
+			want:  "%",
+		},
+		{
+			name:  "env fills in what the file leaves out",
+			file:  "prefix: \"?\"\n",
+			env:   map[string]string{"DISCORD_TOKEN": "abc"},
+			check: func(config *botConfig) interface{} { return config.Token },
+			want:  "abc",
+		},
+		{
+			name:  "flag int over file",
+			file:  "token: abc\nmaxQueueDepth: 3\n",
+			flags: map[string]string{"max-queue-depth": "7"},
+			check: func(config *botConfig) interface{} { return config.MaxQueueDepth },
+			want:  7,
+		},
+		{
+			name:  "env list",
+			file:  "token: abc\nplaybackControlRoles: [\"1\"]\n",
+			env:   map[string]string{"AKU_PLAYBACK_CONTROL_ROLES": "2, 3,,"},
+			check: func(config *botConfig) interface{} { return config.PlaybackControlRoles },
+			want:  []string{"2", "3"},
+		},
+		{
+			name:  "paths follow the root",
+			file:  "token: abc\nrootDir: /srv/aku\n",
+			flags: map[string]string{"root-dir": "/opt/aku"},
+			check: func(config *botConfig) interface{} { return config.CachePath },
+			want:  "/opt/aku/cache",
+		},
+		{
+			name:  "paths set on their own",
+			file:  "token: abc\nrootDir: /srv/aku\naudioPath: /media/sounds\n",
+			check: func(config *botConfig) interface{} { return config.AudioPath },
+			want:  "/media/sounds",
+		},
+		{
+			name:   "unknown key",
+			file:   "token: abc\nresultPerPage: 5\n",
+			hasErr: true,
+		},
+		{
+			name:   "bad env int",
+			file:   "token: abc\n",
+			env:    map[string]string{"AKU_RESULTS_PER_PAGE": "lots"},
+			hasErr: true,
+		},
+		{
+			name:   "invalid after overrides",
+			file:   "token: abc\n",
+			flags:  map[string]string{"results-per-page": "0"},
+			hasErr: true,
+		},
+		{
+			name:   "cache holding the root",
+			file:   "token: abc\nrootDir: /srv/aku\ncachePath: /srv\n",
+			hasErr: true,
+		},
+		{
+			name:   "cache is the audio",
+			file:   "token: abc\nrootDir: /srv/aku\ncachePath: /srv/aku/audio/\n",
+			hasErr: true,
+		},
+		{
+			name:  "cache beside the audio",
+			file:  "token: abc\nrootDir: /srv/aku\ncachePath: /srv/aku/audio-cache\n",
+			check: func(config *botConfig) interface{} { return config.CachePath },
+			want:  "/srv/aku/audio-cache",
+		},
+		{
+			name:   "no token",
+			file:   "prefix: \"?\"\n",
+			hasErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Start with none of the settings in the environment. Setenv puts
+			// back whatever was there once the test is done.
+			for _, setting := range configSettings {
+				t.Setenv(setting.env, "")
+				os.Unsetenv(setting.env)
+			}
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+
+			configPath = filepath.Join(t.TempDir(), "config.yaml")
+			if err := ioutil.WriteFile(configPath, []byte(test.file), 0600); err != nil {
+				t.Fatal(err)
+			}
+			configFlags = make(map[string]string)
+			for name, value := range test.flags {
+				configFlags[name] = value
+			}
+			defer func() {
+				configPath = ""
+				configFlags = make(map[string]string)
+			}()
+
+			config, err := loadConfig()
+			if test.hasErr {
+				if err == nil {
+					t.Errorf("loadConfig() = %+v, want an error", config)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadConfig() error = %v", err)
+			}
+			if got := test.check(config); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	configPath = filepath.Join(t.TempDir(), "missing.yaml")
+	defer func() { configPath = "" }()
+
+	if _, err := loadConfig(); err == nil {
+		t.Error("A config file that was asked for but doesn't exist should be an error")
+	}
+}
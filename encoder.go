@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+const defaultEncodeWorkers = 2
+
+// Log progress every this many finished encodes
+const encodeProgressInterval = 25
+
+type encodeJob struct {
+	soundName string
+	soundPath string
+}
+
+// encodePool converts the library into the cache in the background, entry
+// sounds first and then the most played, so that few sounds have to wait on
+// an encode when they're played
+type encodePool struct {
+	lock    sync.Mutex
+	wake    *sync.Cond
+	pending map[string]encodeJob
+	// The pending jobs, highest priority first. It's sorted again when jobs
+	// are scheduled or play counts change, which is rare next to jobs being
+	// taken off the front.
+	order             []encodeJob
+	orderStale        bool
+	orderPlaysVersion int
+	active            int
+	finished          int
+	failed            int
+}
+
+var backgroundEncoder *encodePool
+
+func startEncodePool(workers int) *encodePool {
+	pool := &encodePool{pending: make(map[string]encodeJob)}
+	pool.wake = sync.NewCond(&pool.lock)
+
+	for i := 0; i < workers; i++ {
+		go pool.work()
+	}
+
+	log.Info().
+		Int("workers", workers).
+		Msg("Started background encoder")
+	return pool
+}
+
+// schedule queues a sound for encoding, replacing any queued job for the same
+// sound
+func (pool *encodePool) schedule(soundName string, soundPath string) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.pending[soundName] = encodeJob{soundName, soundPath}
+	pool.orderStale = true
+	pool.wake.Signal()
+}
+
+func (pool *encodePool) scheduleAll(sounds map[string]string) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for soundName, soundPath := range sounds {
+		pool.pending[soundName] = encodeJob{soundName, soundPath}
+	}
+	pool.orderStale = true
+	pool.wake.Broadcast()
+
+	log.Info().
+		Int("sounds", len(sounds)).
+		Msg("Scheduled background encoding")
+}
+
+func isEntrySound(soundName string) bool {
+	return strings.HasPrefix(soundName, entrySoundsCategory+"/")
+}
+
+// hasPriorityOver orders jobs by entry sounds first, then play count, then
+// name so the order is stable
+func hasPriorityOver(job encodeJob, other encodeJob, playCounts map[string]int) bool {
+	if isEntrySound(job.soundName) != isEntrySound(other.soundName) {
+		return isEntrySound(job.soundName)
+	}
+	jobPlays := playCounts[job.soundName]
+	otherPlays := playCounts[other.soundName]
+	if jobPlays != otherPlays {
+		return jobPlays > otherPlays
+	}
+	return job.soundName < other.soundName
+}
+
+// sortPending orders the pending jobs by priority. It must be called with
+// the pool's lock held.
+func (pool *encodePool) sortPending() {
+	playCounts, version := snapshotPlayCounts()
+
+	pool.order = make([]encodeJob, 0, len(pool.pending))
+	for _, job := range pool.pending {
+		pool.order = append(pool.order, job)
+	}
+	sort.Slice(pool.order, func(i, j int) bool {
+		return hasPriorityOver(pool.order[i], pool.order[j], playCounts)
+	})
+	pool.orderStale = false
+	pool.orderPlaysVersion = version
+}
+
+// next blocks until there's a job and takes the highest priority one. Play
+// counts change as the library is encoded, so the order is kept up to date
+// with them rather than sorted once up front.
+func (pool *encodePool) next() encodeJob {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	for len(pool.pending) == 0 {
+		pool.wake.Wait()
+	}
+
+	if pool.orderStale || getPlayCountsVersion() != pool.orderPlaysVersion {
+		pool.sortPending()
+	}
+	best := pool.order[0]
+	pool.order = pool.order[1:]
+	delete(pool.pending, best.soundName)
+	pool.active++
+	return best
+}
+
+func (pool *encodePool) work() {
+	for {
+		job := pool.next()
+
+		// The sound may have been removed or replaced since it was scheduled
+		sound, found := audioAssets.Lookup(job.soundName)
+		if !found || sound.path != job.soundPath {
+			pool.finish(nil)
+			continue
+		}
+
+		// Guilds with their own volume have their conversions made on demand
+		encodeOptions := getEncodeOptions(sound.metadata, defaultGuildVolume)
+		convertedSoundPath, err := getConvertedSoundCachePath(job.soundName, job.soundPath, encodeOptions)
+		if err == nil {
+			err = ensureConverted(job.soundName, job.soundPath, convertedSoundPath, encodeOptions)
+		}
+		if err != nil {
+			log.Error().
+				Err(err).
+				Str("soundName", job.soundName).
+				Msg("Background encode failed")
+		}
+
+		pool.finish(err)
+	}
+}
+
+func (pool *encodePool) finish(err error) {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	pool.active--
+	pool.finished++
+	if err != nil {
+		pool.failed++
+	}
+
+	if len(pool.pending) == 0 && pool.active == 0 {
+		log.Info().
+			Int("finished", pool.finished).
+			Int("failed", pool.failed).
+			Msg("Background encoding caught up")
+	} else if pool.finished%encodeProgressInterval == 0 {
+		log.Info().
+			Int("finished", pool.finished).
+			Int("failed", pool.failed).
+			Int("remaining", len(pool.pending)+pool.active).
+			Msg("Background encoding progress")
+	}
+}
+
+func (pool *encodePool) describeProgress() string {
+	pool.lock.Lock()
+	defer pool.lock.Unlock()
+
+	return fmt.Sprintf("%d sounds ready (%d failed), %d encoding, %d waiting",
+		pool.finished, pool.failed, pool.active, len(pool.pending))
+}
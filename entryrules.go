@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+	// Quiet hours need time zones even where the system has none installed
+	_ "time/tzdata"
+
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const randomPick = "random"
+const roundRobinPick = "roundrobin"
+
+// Guild ID and user ID to the entry sound rules overridden for them in that
+// guild
+var userEntrySoundRulesBucket = []byte("userEntrySoundRules")
+
+// entrySoundRules decide when entry sounds play. They're layered from the
+// config file, then the guild's settings, then the user's, with unset rules
+// falling through to the layer below.
+type entrySoundRules struct {
+	// Seconds after someone's entry sound plays before it can play again
+	CooldownSeconds *int `json:"cooldownSeconds,omitempty" yaml:"cooldownSeconds"`
+	// Play when moving between channels, not just on joining voice
+	OnMove *bool `json:"onMove,omitempty" yaml:"onMove"`
+	// Play an exit sound in the channel someone left
+	OnExit *bool `json:"onExit,omitempty" yaml:"onExit"`
+	// Time range like 22:00-07:00 when nothing plays, or empty for none
+	QuietHours *string `json:"quietHours,omitempty" yaml:"quietHours"`
+	// Time zone the quiet hours are in, like Europe/Berlin, or empty for UTC
+	Timezone *string `json:"timezone,omitempty" yaml:"timezone"`
+	// How sounds are picked from someone's pool, random or roundrobin
+	Pick *string `json:"pick,omitempty" yaml:"pick"`
+}
+
+func (rules entrySoundRules) isDefault() bool {
+	return rules == (entrySoundRules{})
+}
+
+// overriddenBy returns these rules with any set in override replacing them
+func (rules entrySoundRules) overriddenBy(override entrySoundRules) entrySoundRules {
+	if override.CooldownSeconds != nil {
+		rules.CooldownSeconds = override.CooldownSeconds
+	}
+	if override.OnMove != nil {
+		rules.OnMove = override.OnMove
+	}
+	if override.OnExit != nil {
+		rules.OnExit = override.OnExit
+	}
+	if override.QuietHours != nil {
+		rules.QuietHours = override.QuietHours
+	}
+	if override.Timezone != nil {
+		rules.Timezone = override.Timezone
+	}
+	if override.Pick != nil {
+		rules.Pick = override.Pick
+	}
+	return rules
+}
+
+func (rules entrySoundRules) getCooldown() time.Duration {
+	if rules.CooldownSeconds == nil {
+		return 0
+	}
+	return time.Duration(*rules.CooldownSeconds) * time.Second
+}
+
+func (rules entrySoundRules) playsOnMove() bool {
+	return rules.OnMove != nil && *rules.OnMove
+}
+
+func (rules entrySoundRules) playsOnExit() bool {
+	return rules.OnExit != nil && *rules.OnExit
+}
+
+func (rules entrySoundRules) picksRoundRobin() bool {
+	return rules.Pick != nil && *rules.Pick == roundRobinPick
+}
+
+func (rules entrySoundRules) getTimezone() *time.Location {
+	if rules.Timezone == nil || *rules.Timezone == "" {
+		return time.UTC
+	}
+	location, err := time.LoadLocation(*rules.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
+
+// isQuietAt reports whether now falls in the quiet hours, which may wrap past
+// midnight
+func (rules entrySoundRules) isQuietAt(now time.Time) bool {
+	if rules.QuietHours == nil || *rules.QuietHours == "" {
+		return false
+	}
+	start, end, err := parseQuietHours(*rules.QuietHours)
+	if err != nil {
+		return false
+	}
+
+	now = now.In(rules.getTimezone())
+	minute := now.Hour()*60 + now.Minute()
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+func (rules entrySoundRules) describe() string {
+	cooldown := "none"
+	if rules.getCooldown() > 0 {
+		cooldown = rules.getCooldown().String()
+	}
+	quietHours := "none"
+	if rules.QuietHours != nil && *rules.QuietHours != "" {
+		quietHours = *rules.QuietHours + " " + rules.getTimezone().String()
+	}
+	pick := randomPick
+	if rules.picksRoundRobin() {
+		pick = roundRobinPick
+	}
+	return fmt.Sprintf("cooldown %s, moves %s, exits %s, quiet hours %s, pick %s",
+		cooldown, describeOnOff(rules.playsOnMove()), describeOnOff(rules.playsOnExit()), quietHours, pick)
+}
+
+func describeOnOff(on bool) string {
+	if on {
+		return "on"
+	}
+	return "off"
+}
+
+// parseQuietHours reads a range like 22:00-07:00 into minutes past midnight
+func parseQuietHours(quietHours string) (int, int, error) {
+	parts := strings.SplitN(quietHours, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Quiet hours %q should look like 22:00-07:00", quietHours)
+	}
+
+	minutes := make([]int, 2)
+	for i, part := range parts {
+		parsed, err := time.Parse("15:04", strings.TrimSpace(part))
+		if err != nil {
+			return 0, 0, fmt.Errorf("Quiet hours %q should look like 22:00-07:00", quietHours)
+		}
+		minutes[i] = parsed.Hour()*60 + parsed.Minute()
+	}
+	return minutes[0], minutes[1], nil
+}
+
+func getUserEntrySoundRules(guildID string, userID string) entrySoundRules {
+	var rules entrySoundRules
+
+	err := settingsDB.View(func(tx *bolt.Tx) error {
+		encoded := tx.Bucket(userEntrySoundRulesBucket).Get([]byte(getGuildUserKey(guildID, userID)))
+		if encoded == nil {
+			return nil
+		}
+		return json.Unmarshal(encoded, &rules)
+	})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("guildID", guildID).
+			Str("userID", userID).
+			Msg("Failed to read entry sound rules")
+		return entrySoundRules{}
+	}
+	return rules
+}
+
+func updateUserEntrySoundRules(guildID string, userID string, update func(*entrySoundRules)) error {
+	key := []byte(getGuildUserKey(guildID, userID))
+
+	return settingsDB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(userEntrySoundRulesBucket)
+
+		var rules entrySoundRules
+		if encoded := bucket.Get(key); encoded != nil {
+			if err := json.Unmarshal(encoded, &rules); err != nil {
+				return err
+			}
+		}
+
+		update(&rules)
+		if rules.isDefault() {
+			return bucket.Delete(key)
+		}
+
+		encoded, err := json.Marshal(rules)
+		if err != nil {
+			return err
+		}
+		return bucket.Put(key, encoded)
+	})
+}
+
+// getEntrySoundRules returns the rules in effect for a user in a guild
+func getEntrySoundRules(guildID string, userID string) entrySoundRules {
+	return getConfig().EntrySoundRules.
+		overriddenBy(getGuildSettings(guildID).EntrySoundRules).
+		overriddenBy(getUserEntrySoundRules(guildID, userID))
+}
+
+// setEntrySoundRule parses a rule from a command and applies it to rules. An
+// empty value unsets the rule so it falls through to the layer below.
+func setEntrySoundRule(rules *entrySoundRules, rule string, value string) error {
+	switch rule {
+	case "cooldown":
+		if value == "" {
+			rules.CooldownSeconds = nil
+			return nil
+		}
+		var cooldownSeconds int
+		if _, err := fmt.Sscan(strings.TrimSuffix(value, "s"), &cooldownSeconds); err != nil || cooldownSeconds < 0 {
+			return errors.New("The cooldown has to be a number of seconds")
+		}
+		rules.CooldownSeconds = &cooldownSeconds
+	case "moves", "exits":
+		var on *bool
+		switch value {
+		case "":
+		case "on", "off":
+			enabled := value == "on"
+			on = &enabled
+		default:
+			return fmt.Errorf("%s can be on or off", strings.Title(rule))
+		}
+		if rule == "moves" {
+			rules.OnMove = on
+		} else {
+			rules.OnExit = on
+		}
+	case "quiet":
+		if value == "" {
+			rules.QuietHours = nil
+			return nil
+		}
+		if value == "off" {
+			value = ""
+		} else if _, _, err := parseQuietHours(value); err != nil {
+			return err
+		}
+		rules.QuietHours = &value
+	case "timezone":
+		if value == "" {
+			rules.Timezone = nil
+			return nil
+		}
+		if _, err := time.LoadLocation(value); err != nil {
+			return fmt.Errorf("No time zone called %s", value)
+		}
+		rules.Timezone = &value
+	case "pick":
+		switch value {
+		case "":
+			rules.Pick = nil
+		case randomPick, roundRobinPick:
+			rules.Pick = &value
+		default:
+			return errors.New("Pick can be random or roundrobin")
+		}
+	default:
+		return errors.New("Rules are cooldown, moves, exits, quiet, timezone and pick")
+	}
+	return nil
+}
+
+// Guild ID and user ID to when their entry sound last played
+var lastEntrySounds map[string]time.Time
+var lastEntrySoundsLock sync.Mutex
+
+// checkEntrySoundCooldown reports whether a user's entry sound cooldown has
+// passed in a guild, and if so starts it again. Exit sounds don't have one.
+func checkEntrySoundCooldown(guildID string, userID string, cooldown time.Duration) bool {
+	lastEntrySoundsLock.Lock()
+	defer lastEntrySoundsLock.Unlock()
+
+	key := getGuildUserKey(guildID, userID)
+	now := time.Now()
+	if lastPlayed, found := lastEntrySounds[key]; found && now.Sub(lastPlayed) < cooldown {
+		return false
+	}
+	lastEntrySounds[key] = now
+	return true
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseQuietHours(t *testing.T) {
+	tests := []struct {
+		quietHours string
+		start      int
+		end        int
+		valid      bool
+	}{
+		{"22:00-07:00", 22 * 60, 7 * 60, true},
+		{"09:30-17:45", 9*60 + 30, 17*60 + 45, true},
+		{" 22:00 - 07:00 ", 22 * 60, 7 * 60, true},
+		{"00:00-00:00", 0, 0, true},
+		{"22:00", 0, 0, false},
+		{"22-07", 0, 0, false},
+		{"25:00-07:00", 0, 0, false},
+		{"22:00-07:60", 0, 0, false},
+		{"", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		start, end, err := parseQuietHours(test.quietHours)
+		if (err == nil) != test.valid {
+			t.Errorf("parseQuietHours(%q) error = %v, want valid %t", test.quietHours, err, test.valid)
+			continue
+		}
+		if test.valid && (start != test.start || end != test.end) {
+			t.Errorf("parseQuietHours(%q) = %d, %d, want %d, %d", test.quietHours, start, end, test.start, test.end)
+		}
+	}
+}
+
+func TestIsQuietAt(t *testing.T) {
+	quietHours := func(quietHours string, timezone string) entrySoundRules {
+		return entrySoundRules{QuietHours: &quietHours, Timezone: &timezone}
+	}
+	at := func(hour int, minute int) time.Time {
+		return time.Date(2024, time.March, 1, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		name  string
+		rules entrySoundRules
+		now   time.Time
+		quiet bool
+	}{
+		{"unset", entrySoundRules{}, at(3, 0), false},
+		{"off", quietHours("", ""), at(3, 0), false},
+		{"invalid", quietHours("late", ""), at(3, 0), false},
+
+		{"same day before", quietHours("09:00-17:00", ""), at(8, 59), false},
+		{"same day start", quietHours("09:00-17:00", ""), at(9, 0), true},
+		{"same day during", quietHours("09:00-17:00", ""), at(12, 0), true},
+		{"same day end", quietHours("09:00-17:00", ""), at(17, 0), false},
+
+		{"wrapping before", quietHours("22:00-07:00", ""), at(21, 59), false},
+		{"wrapping start", quietHours("22:00-07:00", ""), at(22, 0), true},
+		{"wrapping before midnight", quietHours("22:00-07:00", ""), at(23, 59), true},
+		{"wrapping midnight", quietHours("22:00-07:00", ""), at(0, 0), true},
+		{"wrapping after midnight", quietHours("22:00-07:00", ""), at(6, 59), true},
+		{"wrapping end", quietHours("22:00-07:00", ""), at(7, 0), false},
+		{"wrapping afternoon", quietHours("22:00-07:00", ""), at(12, 0), false},
+
+		{"empty range", quietHours("00:00-00:00", ""), at(0, 0), false},
+
+		// 21:30 UTC is 22:30 in Berlin in winter
+		{"time zone", quietHours("22:00-07:00", "Europe/Berlin"), at(21, 30), true},
+		{"time zone outside", quietHours("22:00-07:00", "Europe/Berlin"), at(6, 30), false},
+		{"bad time zone falls back to UTC", quietHours("22:00-07:00", "Mars/Olympus"), at(21, 30), false},
+	}
+
+	for _, test := range tests {
+		if quiet := test.rules.isQuietAt(test.now); quiet != test.quiet {
+			t.Errorf("%s: isQuietAt(%s) = %t, want %t", test.name, test.now.Format("15:04"), quiet, test.quiet)
+		}
+	}
+}
+
+func TestEntrySoundRulesOverriddenBy(t *testing.T) {
+	cooldown := 60
+	noCooldown := 0
+	on := true
+	quietHours := "22:00-07:00"
+
+	base := entrySoundRules{CooldownSeconds: &cooldown, OnMove: &on, QuietHours: &quietHours}
+	rules := base.overriddenBy(entrySoundRules{CooldownSeconds: &noCooldown})
+
+	if rules.getCooldown() != 0 {
+		t.Errorf("Overridden cooldown = %s, want 0s", rules.getCooldown())
+	}
+	if !rules.playsOnMove() {
+		t.Error("Unset rules should fall through to the layer below")
+	}
+	if rules.QuietHours == nil || *rules.QuietHours != quietHours {
+		t.Errorf("Unset quiet hours should fall through, got %v", rules.QuietHours)
+	}
+	if base.getCooldown() != time.Minute {
+		t.Errorf("Overriding changed the rules below to %s", base.getCooldown())
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Guild ID and user ID to the qualified name of someone's entry or exit
+// sound in that guild. Entry sounds migrated from old style usernames are
+// kept under the bare user ID, since they came from the sound library rather
+// than any one guild.
+var entrySoundsBucket = []byte("entrySounds")
+var exitSoundsBucket = []byte("exitSounds")
+
+// Sounds named after a user's ID with this suffix are their exit sound
+const exitSoundSuffix = "_exit"
+
+func getMappedSound(soundsBucket []byte, userID string) (string, bool) {
+	var soundName string
+
+	err := settingsDB.View(func(tx *bolt.Tx) error {
+		soundName = string(tx.Bucket(soundsBucket).Get([]byte(userID)))
+		return nil
+	})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("bucket", string(soundsBucket)).
+			Str("userID", userID).
+			Msg("Failed to read user's sound")
+	}
+	return soundName, soundName != ""
+}
+
+// setMappedSound maps a user to their entry or exit sound, or clears it if
+// soundName is empty
+func setMappedSound(soundsBucket []byte, userID string, soundName string) error {
+	return settingsDB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(soundsBucket)
+		if soundName == "" {
+			return bucket.Delete([]byte(userID))
+		}
+		return bucket.Put([]byte(userID), []byte(soundName))
+	})
+}
+
+// Entry sounds can also be kept in a folder per user, with a folder per
+// guild inside it for sounds that only play there
+const entrySoundsCategory = "entries"
+
+// getEntrySoundPool finds the sounds a user's entry sound is picked from in
+// a guild. Sounds set or foldered for the guild come first, then one migrated
+// for them, then their folder, then a sound named after their ID. Sounds
+// named after their old style Name#1234 username still work, and get mapped
+// to their ID the first time they're used since the name won't stay accurate.
+func getEntrySoundPool(guildID string, user *discordgo.User) []registeredAsset {
+	userCategory := getQualifiedAssetName(entrySoundsCategory, user.ID)
+
+	if soundName, found := getMappedSound(entrySoundsBucket, getGuildUserKey(guildID, user.ID)); found {
+		return getSoundPool(user.ID, soundName)
+	}
+	if pool := getCategoryPool(getQualifiedAssetName(userCategory, guildID)); len(pool) > 0 {
+		return pool
+	}
+	if soundName, found := getMappedSound(entrySoundsBucket, user.ID); found {
+		return getSoundPool(user.ID, soundName)
+	}
+	if pool := getCategoryPool(userCategory); len(pool) > 0 {
+		return pool
+	}
+	if _, found := audioAssets.Lookup(user.ID); found {
+		return getSoundPool(user.ID, user.ID)
+	}
+
+	// Users that moved to unique usernames have no discriminator
+	if user.Discriminator == "" || user.Discriminator == "0" {
+		return nil
+	}
+	sound, found := audioAssets.Lookup(getUniqueUsername(user))
+	if !found {
+		return nil
+	}
+
+	if err := setMappedSound(entrySoundsBucket, user.ID, sound.qualifiedName()); err != nil {
+		log.Error().
+			Err(err).
+			Str("userID", user.ID).
+			Msg("Failed to migrate entry sound")
+	} else {
+		log.Info().
+			Str("userID", user.ID).
+			Str("soundName", sound.qualifiedName()).
+			Msg("Migrated entry sound to user ID")
+	}
+	return getSoundPool(user.ID, sound.qualifiedName())
+}
+
+// getSoundPool resolves what a user's sound is set to into the sounds to pick
+// from: every sound directly in it if it's a category, or else the sound and
+// any others listed in its metadata's pool
+func getSoundPool(userID string, soundName string) []registeredAsset {
+	if _, found := audioAssets.ListCategory(soundName); found {
+		return getCategoryPool(soundName)
+	}
+
+	pool := make([]registeredAsset, 0)
+	sound, found := audioAssets.Lookup(soundName)
+	if !found {
+		log.Warn().
+			Str("userID", userID).
+			Str("soundName", soundName).
+			Msg("User's sound is gone")
+		return pool
+	}
+	pool = append(pool, sound)
+	for _, poolName := range sound.metadata.Pool {
+		if poolSound, found := audioAssets.Lookup(poolName); found {
+			pool = append(pool, poolSound)
+		} else {
+			log.Warn().
+				Str("soundName", sound.qualifiedName()).
+				Str("poolName", poolName).
+				Msg("Sound in pool is gone")
+		}
+	}
+	return pool
+}
+
+// getCategoryPool returns every sound directly in a category, or none if
+// there's no such category. Most users don't have a folder, so it being
+// missing isn't worth a warning.
+func getCategoryPool(category string) []registeredAsset {
+	pool := make([]registeredAsset, 0)
+
+	names, _ := audioAssets.ListCategory(category)
+	for _, name := range names {
+		if sound, found := audioAssets.Lookup(getQualifiedAssetName(category, name)); found {
+			pool = append(pool, sound)
+		}
+	}
+	return pool
+}
+
+// getGuildUserKey is how settings for a user that only apply in one guild
+// are stored
+func getGuildUserKey(guildID string, userID string) string {
+	return guildID + "/" + userID
+}
+
+// Guild ID and user ID to the position of the next round robin pick
+var entrySoundTurns map[string]int
+var entrySoundTurnsLock sync.Mutex
+
+// pickPoolSound picks a sound from a pool the way the rules say to, with
+// round robin picks kept apart by key
+func pickPoolSound(key string, pool []registeredAsset, rules entrySoundRules) (registeredAsset, bool) {
+	if len(pool) == 0 {
+		return registeredAsset{}, false
+	}
+	if !rules.picksRoundRobin() {
+		return pool[rand.Intn(len(pool))], true
+	}
+
+	entrySoundTurnsLock.Lock()
+	defer entrySoundTurnsLock.Unlock()
+
+	turn := entrySoundTurns[key] % len(pool)
+	entrySoundTurns[key] = turn + 1
+	return pool[turn], true
+}
+
+func getEntrySound(guildID string, user *discordgo.User, rules entrySoundRules) (registeredAsset, bool) {
+	return pickPoolSound(getGuildUserKey(guildID, user.ID), getEntrySoundPool(guildID, user), rules)
+}
+
+// getExitSound finds a user's exit sound from what's been set for them in
+// the guild, or else a sound named after their ID with the exit suffix
+func getExitSound(guildID string, user *discordgo.User, rules entrySoundRules) (registeredAsset, bool) {
+	var pool []registeredAsset
+	if soundName, found := getMappedSound(exitSoundsBucket, getGuildUserKey(guildID, user.ID)); found {
+		pool = getSoundPool(user.ID, soundName)
+	} else if _, found := audioAssets.Lookup(user.ID + exitSoundSuffix); found {
+		pool = getSoundPool(user.ID, user.ID+exitSoundSuffix)
+	}
+	return pickPoolSound(getGuildUserKey(guildID, user.ID)+exitSoundSuffix, pool, rules)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+const exactMatchScore = 1000
+const prefixMatchScore = 300
+const substringMatchScore = 200
+const editMatchScore = 150
+const editDistancePenalty = 50
+
+// The best match has to beat the runner up by this much to be picked without
+// asking the user
+const uniqueMatchMargin = 100
+const maxSuggestions = 3
+
+type fuzzyMatch struct {
+	name  string
+	score int
+}
+
+func levenshteinDistance(a string, b string) int {
+	aRunes := []rune(a)
+	bRunes := []rune(b)
+
+	previousRow := make([]int, len(bRunes)+1)
+	currentRow := make([]int, len(bRunes)+1)
+	for j := range previousRow {
+		previousRow[j] = j
+	}
+
+	for i := 1; i <= len(aRunes); i++ {
+		currentRow[0] = i
+		for j := 1; j <= len(bRunes); j++ {
+			substitutionCost := 1
+			if aRunes[i-1] == bRunes[j-1] {
+				substitutionCost = 0
+			}
+			currentRow[j] = minInt(
+				previousRow[j]+1,
+				currentRow[j-1]+1,
+				previousRow[j-1]+substitutionCost)
+		}
+		previousRow, currentRow = currentRow, previousRow
+	}
+	return previousRow[len(bRunes)]
+}
+
+func minInt(first int, rest ...int) int {
+	min := first
+	for _, value := range rest {
+		if value < min {
+			min = value
+		}
+	}
+	return min
+}
+
+// getFuzzyScore scores how well a candidate matches a query, or returns 0 if
+// it doesn't match at all. Exact matches beat prefixes, which beat
+// substrings, which beat near misses by edit distance; shorter candidates win
+// within prefix and substring matches since more of them was typed.
+func getFuzzyScore(query string, candidate string) int {
+	query = strings.ToLower(query)
+	candidate = strings.ToLower(candidate)
+	if query == "" || candidate == "" {
+		return 0
+	}
+
+	coverage := 100 * len(query) / len(candidate)
+	switch {
+	case candidate == query:
+		return exactMatchScore
+	case strings.HasPrefix(candidate, query):
+		return prefixMatchScore + coverage
+	case strings.Contains(candidate, query):
+		return substringMatchScore + coverage
+	}
+
+	maxDistance := 1 + len(query)/5
+	distance := levenshteinDistance(query, candidate)
+	if distance > maxDistance {
+		return 0
+	}
+	return editMatchScore - editDistancePenalty*distance
+}
+
+// rankFuzzyMatches returns every candidate matching the query, best first
+func rankFuzzyMatches(query string, candidates []string) []fuzzyMatch {
+	matches := make([]fuzzyMatch, 0)
+	for _, candidate := range candidates {
+		score := getFuzzyScore(query, candidate)
+		if score > 0 {
+			matches = append(matches, fuzzyMatch{candidate, score})
+		}
+	}
+
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].name < matches[j].name
+	})
+	return matches
+}
+
+// pickFuzzyMatch returns the best match if it clearly beats the rest
+func pickFuzzyMatch(matches []fuzzyMatch) (string, bool) {
+	if len(matches) == 0 {
+		return "", false
+	}
+	if len(matches) == 1 || matches[0].score-matches[1].score >= uniqueMatchMargin {
+		return matches[0].name, true
+	}
+	return "", false
+}
+
+func getSuggestions(matches []fuzzyMatch) []string {
+	suggestions := make([]string, 0, maxSuggestions)
+	for _, match := range matches {
+		if len(suggestions) == maxSuggestions {
+			break
+		}
+		suggestions = append(suggestions, match.name)
+	}
+	return suggestions
+}
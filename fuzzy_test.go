@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestLevenshteinDistance(t *testing.T) {
+	tests := []struct {
+		a        string
+		b        string
+		distance int
+	}{
+		{"", "", 0},
+		{"", "bruh", 4},
+		{"bruh", "", 4},
+		{"bruh", "bruh", 0},
+		{"bruh", "bruhh", 1},
+		{"bruh", "bru", 1},
+		{"bruh", "brah", 1},
+		{"kitten", "sitting", 3},
+		{"flaw", "lawn", 2},
+		// Runes, not bytes
+		{"café", "cafe", 1},
+	}
+
+	for _, test := range tests {
+		if distance := levenshteinDistance(test.a, test.b); distance != test.distance {
+			t.Errorf("levenshteinDistance(%q, %q) = %d, want %d", test.a, test.b, distance, test.distance)
+		}
+		if distance := levenshteinDistance(test.b, test.a); distance != test.distance {
+			t.Errorf("levenshteinDistance(%q, %q) = %d, want %d", test.b, test.a, distance, test.distance)
+		}
+	}
+}
+
+func TestGetFuzzyScore(t *testing.T) {
+	tests := []struct {
+		query     string
+		candidate string
+		score     int
+	}{
+		{"bruh", "bruh", exactMatchScore},
+		{"BRUH", "bruh", exactMatchScore},
+		{"bruh", "bruh_moment", prefixMatchScore + 100*4/11},
+		{"moment", "bruh_moment", substringMatchScore + 100*6/11},
+		{"brah", "bruh", editMatchScore - editDistancePenalty},
+		// Short queries only get one edit
+		{"bra", "bruh", 0},
+		{"yeet", "bruh", 0},
+		{"", "bruh", 0},
+		{"bruh", "", 0},
+	}
+
+	for _, test := range tests {
+		if score := getFuzzyScore(test.query, test.candidate); score != test.score {
+			t.Errorf("getFuzzyScore(%q, %q) = %d, want %d", test.query, test.candidate, score, test.score)
+		}
+	}
+}
+
+func TestGetFuzzyScoreOrdering(t *testing.T) {
+	// Each candidate should score higher than the next for the query
+	tests := []struct {
+		query      string
+		candidates []string
+	}{
+		{"bruh", []string{"bruh", "bruh2", "bruh_moment", "big_bruh", "brah"}},
+		{"oof", []string{"oof", "oof_long_version", "big_oof_energy"}},
+	}
+
+	for _, test := range tests {
+		for i := 1; i < len(test.candidates); i++ {
+			better := getFuzzyScore(test.query, test.candidates[i-1])
+			worse := getFuzzyScore(test.query, test.candidates[i])
+			if better <= worse {
+				t.Errorf("%q: %q scored %d, which doesn't beat %q at %d",
+					test.query, test.candidates[i-1], better, test.candidates[i], worse)
+			}
+		}
+	}
+}
@@ -13,5 +13,7 @@ require (
 	github.com/mattn/go-isatty v0.0.18 // indirect
 	github.com/radovskyb/watcher v1.0.7
 	github.com/rs/zerolog v1.29.1
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/crypto v0.8.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+const defaultGuildVolume = 100
+const minGuildVolume = 1
+const maxGuildVolume = 200
+
+const defaultPlaybackLimitSeconds = 10
+const maxPlaybackLimitSeconds = 600
+
+var guildSettingsBucket = []byte("guilds")
+
+// guildSettings holds what a guild has changed from the defaults, with zero
+// values meaning unchanged
+type guildSettings struct {
+	// Percentage sounds are played at
+	Volume int `json:"volume,omitempty"`
+	// Sounds are cut off after this long unless their metadata says otherwise
+	PlaybackLimitSeconds int `json:"playbackLimitSeconds,omitempty"`
+	// Replaces the configured prefix for text commands
+	Prefix              string `json:"prefix,omitempty"`
+	EntrySoundsDisabled bool   `json:"entrySoundsDisabled,omitempty"`
+	// Text channels commands are accepted in, or every channel if empty
+	AllowedChannels []string `json:"allowedChannels,omitempty"`
+	// Override the configured rules for every user in the guild
+	EntrySoundRules entrySoundRules `json:"entrySoundRules"`
+}
+
+func (settings guildSettings) isDefault() bool {
+	return settings.Volume == 0 &&
+		settings.PlaybackLimitSeconds == 0 &&
+		settings.Prefix == "" &&
+		!settings.EntrySoundsDisabled &&
+		len(settings.AllowedChannels) == 0 &&
+		settings.EntrySoundRules.isDefault()
+}
+
+// settingsDB holds everything changed through commands, one bucket per kind
+// of setting
+var settingsDB *bolt.DB
+
+func openSettingsDB() {
+	settingsPath := filepath.Join(rootDir, "settings.db")
+	db, err := bolt.Open(settingsPath, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		log.Fatal().
+			Err(err).
+			Str("settingsPath", settingsPath).
+			Msg("Failed to open settings")
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{guildSettingsBucket, entrySoundsBucket, exitSoundsBucket, userEntrySoundRulesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Fatal().
+			Err(err).
+			Str("settingsPath", settingsPath).
+			Msg("Failed to initialize settings")
+	}
+	settingsDB = db
+}
+
+func closeSettingsDB() {
+	if err := settingsDB.Close(); err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to close settings")
+	}
+}
+
+func getGuildSettings(guildID string) guildSettings {
+	var settings guildSettings
+
+	err := settingsDB.View(func(tx *bolt.Tx) error {
+		encoded := tx.Bucket(guildSettingsBucket).Get([]byte(guildID))
+		if encoded == nil {
+			return nil
+		}
+		return json.Unmarshal(encoded, &settings)
+	})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("guildID", guildID).
+			Msg("Failed to read guild settings, using defaults")
+		return guildSettings{}
+	}
+	return settings
+}
+
+// updateGuildSettings applies a change to a guild's settings and saves them
+func updateGuildSettings(guildID string, update func(*guildSettings)) error {
+	return settingsDB.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(guildSettingsBucket)
+
+		var settings guildSettings
+		if encoded := bucket.Get([]byte(guildID)); encoded != nil {
+			if err := json.Unmarshal(encoded, &settings); err != nil {
+				return err
+			}
+		}
+
+		update(&settings)
+		if settings.isDefault() {
+			return bucket.Delete([]byte(guildID))
+		}
+
+		encoded, err := json.Marshal(settings)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(guildID), encoded)
+	})
+}
+
+func getGuildVolume(guildID string) int {
+	if volume := getGuildSettings(guildID).Volume; volume != 0 {
+		return volume
+	}
+	return defaultGuildVolume
+}
+
+func setGuildVolume(guildID string, volume int) error {
+	if volume == defaultGuildVolume {
+		volume = 0
+	}
+	return updateGuildSettings(guildID, func(settings *guildSettings) {
+		settings.Volume = volume
+	})
+}
+
+// getConfiguredGuildVolumes returns every distinct volume a guild could be
+// playing sounds at, including the default
+func getConfiguredGuildVolumes() []int {
+	seen := map[int]bool{defaultGuildVolume: true}
+	volumes := []int{defaultGuildVolume}
+
+	err := settingsDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(guildSettingsBucket).ForEach(func(guildID []byte, encoded []byte) error {
+			var settings guildSettings
+			if err := json.Unmarshal(encoded, &settings); err != nil {
+				return err
+			}
+			if settings.Volume != 0 && !seen[settings.Volume] {
+				seen[settings.Volume] = true
+				volumes = append(volumes, settings.Volume)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to read guild volumes")
+	}
+	return volumes
+}
+
+func getGuildPlaybackLimit(guildID string) time.Duration {
+	if limit := getGuildSettings(guildID).PlaybackLimitSeconds; limit != 0 {
+		return time.Duration(limit) * time.Second
+	}
+	return time.Duration(getConfig().PlaybackLimitSeconds) * time.Second
+}
+
+func setGuildPlaybackLimit(guildID string, limitSeconds int) error {
+	return updateGuildSettings(guildID, func(settings *guildSettings) {
+		settings.PlaybackLimitSeconds = limitSeconds
+	})
+}
+
+func getGuildPrefix(guildID string) string {
+	if prefix := getGuildSettings(guildID).Prefix; prefix != "" {
+		return prefix
+	}
+	return getConfig().Prefix
+}
+
+func setGuildPrefix(guildID string, prefix string) error {
+	return updateGuildSettings(guildID, func(settings *guildSettings) {
+		settings.Prefix = prefix
+	})
+}
+
+func areEntrySoundsEnabled(guildID string) bool {
+	return !getGuildSettings(guildID).EntrySoundsDisabled
+}
+
+func setEntrySoundsEnabled(guildID string, enabled bool) error {
+	return updateGuildSettings(guildID, func(settings *guildSettings) {
+		settings.EntrySoundsDisabled = !enabled
+	})
+}
+
+func isChannelAllowed(guildID string, channelID string) bool {
+	allowedChannels := getGuildSettings(guildID).AllowedChannels
+	return len(allowedChannels) == 0 || containsString(allowedChannels, channelID)
+}
+
+// setChannelAllowed adds or removes a channel from the ones commands are
+// accepted in
+func setChannelAllowed(guildID string, channelID string, allowed bool) error {
+	return updateGuildSettings(guildID, func(settings *guildSettings) {
+		settings.AllowedChannels = removeWithout(settings.AllowedChannels, channelID)
+		if allowed {
+			settings.AllowedChannels = append(settings.AllowedChannels, channelID)
+		}
+	})
+}
+
+func clearAllowedChannels(guildID string) error {
+	return updateGuildSettings(guildID, func(settings *guildSettings) {
+		settings.AllowedChannels = nil
+	})
+}
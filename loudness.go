@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strings"
+
+	"github.com/jonas747/dca"
+	"github.com/rs/zerolog/log"
+)
+
+// EBU R128 targets every sound is normalized to
+const targetIntegratedLoudness = -16.0
+const targetTruePeak = -1.5
+const targetLoudnessRange = 11.0
+
+// loudnessMeasurement is what ffmpeg's loudnorm filter prints after its
+// analysis pass
+type loudnessMeasurement struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+func getLoudnormFilter() string {
+	return fmt.Sprintf("loudnorm=I=%.1f:TP=%.1f:LRA=%.1f",
+		targetIntegratedLoudness, targetTruePeak, targetLoudnessRange)
+}
+
+func percentToDecibels(percent int) float64 {
+	return 20 * math.Log10(float64(percent)/100)
+}
+
+// getEncodeOptions returns how a sound is encoded for a guild: trimmed and
+// normalized to a common loudness, then adjusted by the sound's own volume and
+// the guild's. These options are what the cache is keyed on; the measured
+// loudness only gets filled in at encode time.
+func getEncodeOptions(metadata assetMetadata, guildVolume int) *dca.EncodeOptions {
+	options := *dca.StdEncodeOptions
+	options.AudioFilter = getLoudnormFilter()
+	if trimFilter := metadata.getTrimFilter(); trimFilter != "" {
+		options.AudioFilter = trimFilter + "," + options.AudioFilter
+	}
+
+	gain := metadata.getGain() + percentToDecibels(guildVolume)
+	if gain != 0 {
+		options.AudioFilter += fmt.Sprintf(",volume=%.2fdB", gain)
+	}
+	return &options
+}
+
+// measureLoudness runs the sound through the same filters it'll be encoded
+// with, so trimming is accounted for, and has loudnorm report what it heard
+func measureLoudness(soundPath string, audioFilter string) (loudnessMeasurement, error) {
+	var measurement loudnessMeasurement
+
+	command := exec.Command("ffmpeg",
+		"-hide_banner", "-nostats",
+		"-i", soundPath,
+		"-af", strings.Replace(audioFilter, getLoudnormFilter(), getLoudnormFilter()+":print_format=json", 1),
+		"-f", "null", "-")
+	var stderr bytes.Buffer
+	command.Stderr = &stderr
+	if err := command.Run(); err != nil {
+		return measurement, err
+	}
+
+	// The measurement is the last thing ffmpeg prints
+	output := stderr.String()
+	start := strings.LastIndex(output, "{")
+	end := strings.LastIndex(output, "}")
+	if start == -1 || end < start {
+		return measurement, errors.New("No loudness measurement in ffmpeg output")
+	}
+
+	err := json.Unmarshal([]byte(output[start:end+1]), &measurement)
+	return measurement, err
+}
+
+// withMeasuredLoudness swaps the single pass loudnorm filter for a two pass
+// one using the sound's measured loudness, which is more accurate and keeps
+// the normalization linear. The single pass filter is kept if measuring
+// fails.
+func withMeasuredLoudness(soundPath string, options *dca.EncodeOptions) *dca.EncodeOptions {
+	measurement, err := measureLoudness(soundPath, options.AudioFilter)
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("soundPath", soundPath).
+			Msg("Failed to measure loudness, normalizing in one pass")
+		return options
+	}
+
+	measuredFilter := fmt.Sprintf("%s:measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+		getLoudnormFilter(),
+		measurement.InputI,
+		measurement.InputTP,
+		measurement.InputLRA,
+		measurement.InputThresh,
+		measurement.TargetOffset)
+
+	measured := *options
+	measured.AudioFilter = strings.Replace(options.AudioFilter, getLoudnormFilter(), measuredFilter, 1)
+	return &measured
+}
@@ -7,10 +7,10 @@ import (
 	"io"
 	"io/ioutil"
 	"math"
+	"math/rand"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -22,24 +22,20 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-const rootDir = "/go-aku"
-const convertedSoundCachePath = "/go-aku/cache"
-const audioPath = "/go-aku/audio"
-const stickerPath = "/go-aku/stickers"
+// Set from the config at startup
+var rootDir string
+var convertedSoundCachePath string
+var audioPath string
+var stickerPath string
 
 type voiceChannelState struct {
 	channel string
 	guild   string
 }
 
-var userVoiceChannel map[string]voiceChannelState
-var afkChannels map[string]string
+var audioAssets *AssetRegistry
+var stickerAssets *AssetRegistry
 
-var audioAssets map[string]string
-var audioHelp map[string][]string
-var audioBusy bool
-
-const resultsPerPage = 10
 const previousPageEmoji = "⬅️"
 const nextPageEmoji = "➡️"
 
@@ -60,28 +56,61 @@ func main() {
 	log.Logger = zerolog.New(consoleWriter).With().Timestamp().Logger()
 	zerolog.SetGlobalLevel(zerolog.InfoLevel)
 
-	// Fetch token
-	token := os.Getenv("DISCORD_TOKEN")
+	// Load config
+	parseConfigFlags()
+	config, err := loadConfig()
+	if err != nil {
+		log.Fatal().
+			Err(err).
+			Msg("Invalid config")
+	}
+	applyConfig(config)
+	rootDir = config.RootDir
+	convertedSoundCachePath = config.CachePath
+	audioPath = config.AudioPath
+	stickerPath = config.StickerPath
 
 	// Initialize silly global state
-	audioBusy = false
 	activeHelpPages = make(map[string]helpPage)
+	guildQueues = make(map[string]*guildQueue)
+	guildVoices = make(map[string]*guildVoice)
+	lastEntrySounds = make(map[string]time.Time)
+	entrySoundTurns = make(map[string]int)
+	recentRandomSounds = make(map[string][]string)
+	rand.Seed(time.Now().UnixNano())
 
 	// Load assets
-	audioAssets, audioHelp = loadAssets(audioPath)
+	audioAssets = loadAssets(audioPath)
+	audioCategoryCount, audioAssetCount := audioAssets.Len()
 	log.Info().
-		Int("categories", len(audioHelp)).
-		Int("sounds", len(audioAssets)).
+		Int("categories", audioCategoryCount).
+		Int("sounds", audioAssetCount).
 		Msg("Loaded sounds")
 
-	// Pre-cache entry sounds
-	initializeConvertedSoundCache(getAssetPathsForCategory(audioAssets, audioHelp["entries"]))
+	// Load stickers
+	stickerAssets = loadAssets(stickerPath)
+	stickerCategoryCount, stickerAssetCount := stickerAssets.Len()
+	log.Info().
+		Int("categories", stickerCategoryCount).
+		Int("stickers", stickerAssetCount).
+		Msg("Loaded stickers")
+
+	// Drop conversions of sounds that are gone, then convert everything else
+	// in the background
+	loadPlayCounts()
+	openSettingsDB()
+	initializeConvertedSoundCache(audioAssets.Assets())
+	backgroundEncoder = startEncodePool(config.EncodeWorkers)
+	backgroundEncoder.scheduleAll(audioAssets.AllPaths())
 
 	// Watch sound directory
-	go watchAssetDir(audioPath, audioAssets, audioHelp)
+	go watchAssetDir(audioPath, audioAssets, backgroundEncoder.schedule, evictConvertedSound)
+
+	// Watch sticker directory
+	go watchAssetDir(stickerPath, stickerAssets, nil, nil)
 
 	// Make Discord session
-	dg, err := discordgo.New("Bot " + token)
+	dg, err := discordgo.New("Bot " + config.Token)
 	if err != nil {
 		log.Fatal().
 			Err(err).
@@ -94,6 +123,7 @@ func main() {
 	dg.AddHandler(onMessage)
 	dg.AddHandler(onVoiceStateUpdate)
 	dg.AddHandler(onMessageReactionAdd)
+	dg.AddHandler(onInteractionCreate)
 
 	// Connect
 	err = dg.Open()
@@ -105,20 +135,33 @@ func main() {
 		os.Exit(1)
 	}
 
+	// Reload config on SIGHUP
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadConfig()
+		}
+	}()
+
 	// Wait until ctrl+c
 	sc := make(chan os.Signal, 1)
 	signal.Notify(sc, syscall.SIGINT, syscall.SIGTERM, os.Interrupt, os.Kill)
 	<-sc
 
-	// Clean up converted sound cache
-	err = os.RemoveAll(convertedSoundCachePath)
-	if err != nil {
-		log.Fatal().
-			Err(err).
-			Str("convertedSoundCachePath", convertedSoundCachePath).
-			Msg("Failed to clean up converted sound cache")
-		return
+	// Leave any voice channels we're idling in
+	disconnectAllVoice()
+	closeSettingsDB()
+}
+
+// writeFileAtomically writes beside the real file and renames over it, so a
+// crash can't leave it half written
+func writeFileAtomically(path string, data []byte) error {
+	tempPath := path + ".tmp"
+	if err := ioutil.WriteFile(tempPath, data, 0600); err != nil {
+		return err
 	}
+	return os.Rename(tempPath, path)
 }
 
 func getUniqueUsername(user *discordgo.User) string {
@@ -141,9 +184,8 @@ func getNormalizedAssetName(assetPath string) string {
 	return strings.TrimSuffix(assetPath, filepath.Ext(assetPath))
 }
 
-func loadAssets(assetPath string) (map[string]string, map[string][]string) {
-	var assetMap = make(map[string]string)
-	var helpMap = make(map[string][]string)
+func loadAssets(assetPath string) *AssetRegistry {
+	var registry = NewAssetRegistry()
 
 	assetDir, err := ioutil.ReadDir(assetPath)
 	if err != nil {
@@ -151,39 +193,46 @@ func loadAssets(assetPath string) (map[string]string, map[string][]string) {
 			Err(err).
 			Str("assetPath", assetPath).
 			Msg("Error reading categories")
-		return nil, nil
+		return registry
 	}
 
 	for _, category := range assetDir {
 		if category.IsDir() {
-			categoryName := category.Name()
+			loadCategory(registry, filepath.Join(assetPath, category.Name()), category.Name())
+		}
+	}
+	return registry
+}
 
-			categoryPath := filepath.Join(assetPath, category.Name())
-			categoryDir, err := ioutil.ReadDir(categoryPath)
-			if err != nil {
-				log.Error().
-					Err(err).
-					Str("categoryPath", categoryPath).
-					Msg("Error reading assets from category")
-				continue
-			}
-			helpMap[categoryName] = make([]string, 0)
-			for _, asset := range categoryDir {
-				if !asset.IsDir() {
-					var assetFileName = asset.Name()
-					var assetName = getNormalizedAssetName(assetFileName)
-					assetMap[assetName] = filepath.Join(categoryPath, assetFileName)
-					helpMap[categoryName] = append(helpMap[categoryName], assetName)
-				}
-			}
+// loadCategory adds a category's assets to the registry, and then does the
+// same for each of its subcategories, which are named by their path from the
+// asset root (e.g. memes/anime)
+func loadCategory(registry *AssetRegistry, categoryPath string, categoryName string) {
+	categoryDir, err := ioutil.ReadDir(categoryPath)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("categoryPath", categoryPath).
+			Msg("Error reading assets from category")
+		return
+	}
+
+	registry.AddCategory(categoryName)
+	for _, asset := range categoryDir {
+		var assetFileName = asset.Name()
+		if asset.IsDir() {
+			loadCategory(registry, filepath.Join(categoryPath, assetFileName), categoryName+"/"+assetFileName)
+		} else if !isSidecarFile(assetFileName) {
+			var assetName = getNormalizedAssetName(assetFileName)
+			var assetPath = filepath.Join(categoryPath, assetFileName)
+			registry.Add(categoryName, assetName, assetPath, loadAssetMetadata(assetPath))
 		}
 	}
-	return assetMap, helpMap
 }
 
-func watchDir(dirPath string, onCreate func(string), onRemove func(string)) {
+func watchDir(dirPath string, onEvent func(watcher.Event)) {
 	w := watcher.New()
-	w.FilterOps(watcher.Create, watcher.Remove)
+	w.FilterOps(watcher.Create, watcher.Remove, watcher.Rename, watcher.Move, watcher.Write)
 
 	done := make(chan bool)
 
@@ -191,16 +240,12 @@ func watchDir(dirPath string, onCreate func(string), onRemove func(string)) {
 		for {
 			select {
 			case event := <-w.Event:
-				if event.Op == watcher.Create {
-					log.Info().Str("event.Path", event.Path).Msg("watcher saw file added")
-					onCreate(filepath.Base(event.Path))
-				} else if event.Op == watcher.Remove {
-					if event.Path == dirPath {
-						done <- true
-						return
-					}
-					onRemove(filepath.Base(event.Path))
+				if event.Op == watcher.Remove && event.Path == dirPath {
+					done <- true
+					return
 				}
+				log.Info().Str("event", event.String()).Str("event.OldPath", event.OldPath).Msg("watcher saw change")
+				onEvent(event)
 			case event := <-w.Error:
 				log.Error().Err(event).Str("dirPath", dirPath).Msg("Error in watch loop")
 			case <-w.Closed:
@@ -210,7 +255,7 @@ func watchDir(dirPath string, onCreate func(string), onRemove func(string)) {
 		}
 	}()
 
-	if err := w.Add(dirPath); err != nil {
+	if err := w.AddRecursive(dirPath); err != nil {
 		log.Error().Err(err).Str("dirPath", dirPath).Msg("Failed to add directory to watcher")
 	}
 
@@ -221,140 +266,137 @@ func watchDir(dirPath string, onCreate func(string), onRemove func(string)) {
 	<-done
 }
 
-func watchAssetDir(assetPath string, assetMap map[string]string, helpMap map[string][]string) {
-	watchDir(assetPath, func(category string) {
-		categoryPath := filepath.Join(assetPath, category)
-		info, err := os.Stat(categoryPath)
-		if err != nil {
-			log.Error().Err(err).Str("categoryPath", categoryPath).Msg("Error statting category directory")
-		}
-		if info.IsDir() {
-			log.Info().Str("category", category).Msg("Added category")
+// getAssetLocation splits a path under assetPath into its category and asset
+// file name. Directories are categories themselves, so their asset file name
+// is empty.
+func getAssetLocation(assetPath string, path string, isDir bool) (string, string, bool) {
+	relativePath, err := filepath.Rel(assetPath, path)
+	if err != nil || relativePath == "." || strings.HasPrefix(relativePath, "..") {
+		return "", "", false
+	}
+	if isDir {
+		return filepath.ToSlash(relativePath), "", true
+	}
+	category, assetFile := filepath.Split(relativePath)
+	if category == "" {
+		// Loose file at the top level
+		return "", assetFile, true
+	}
+	return filepath.ToSlash(filepath.Clean(category)), assetFile, true
+}
 
-			helpMap[category] = make([]string, 0)
-			go watchDir(categoryPath, func(assetFile string) {
-				var assetName = getNormalizedAssetName(assetFile)
-				log.Info().Str("assetName", assetName).Msg("Added asset")
-				assetMap[assetName] = filepath.Join(categoryPath, assetFile)
-				helpMap[category] = append(helpMap[category], assetName)
-			}, func(assetFile string) {
-				log.Info().Str("assetFile", assetFile).Msg("Removed asset")
-			})
-		} else {
-			log.Warn().Str("assetPath", assetPath).Str("category", category).Msg("Unexpected file in category directory")
+// watchAssetDir keeps the registry in sync with the files under assetPath.
+// onAssetAdded, if set, is told about every asset that's been added or
+// rewritten, and onAssetChanged about every asset that's been removed,
+// renamed away or rewritten so anything derived from it can be dropped.
+func watchAssetDir(assetPath string, registry *AssetRegistry, onAssetAdded func(string, string), onAssetChanged func(string)) {
+	notifyAdded := func(assetName string, path string) {
+		if onAssetAdded != nil {
+			onAssetAdded(assetName, path)
 		}
-	}, func(category string) {
-		log.Info().Str("category", category).Msg("Category removed")
-		_, inHelp := helpMap[category]
-		if inHelp {
-			delete(helpMap, category)
+	}
+	notifyChanged := func(assetName string) {
+		if onAssetChanged != nil {
+			onAssetChanged(assetName)
 		}
-	})
-}
-
-func getAssetPathsForCategory(assetPaths map[string]string, categoryAssets []string) map[string]string {
-	targetAssetPaths := make(map[string]string)
-	for _, assetName := range categoryAssets {
-		targetAssetPaths[assetName] = assetPaths[assetName]
 	}
-	return targetAssetPaths
-}
 
-func initializeConvertedSoundCache(initialSounds map[string]string) {
-	cacheDir, err := os.Stat(convertedSoundCachePath)
-	if os.IsNotExist(err) {
-		// Create the cache directory if it doesn't exist
-		if err := os.MkdirAll(convertedSoundCachePath, 0700); err != nil {
-			log.Fatal().
-				Err(err).
-				Msg("Failed to create sound cache directory")
-		}
-	} else if err != nil {
-		log.Fatal().
-			Err(err).
-			Str("convertedSoundCachePath", convertedSoundCachePath).
-			Msg("Error statting sound cache directory")
-		return
-	} else if !cacheDir.IsDir() {
-		log.Fatal().
-			Err(err).
-			Str("convertedSoundCachePath", convertedSoundCachePath).
-			Msg("Sound cache directory is a file")
-		return
-	} else {
-		// Converted sound cache left over from last time
-		err := os.RemoveAll(convertedSoundCachePath)
-		if err != nil {
-			log.Fatal().
-				Err(err).
-				Str("convertedSoundCachePath", convertedSoundCachePath).
-				Msg("Failed to delete existing converted sound cache")
+	// A sidecar changing changes how its asset is used, so it's treated as a
+	// rewrite of the asset
+	sidecarChanged := func(category string, assetFile string, path string) {
+		assetName := getQualifiedAssetName(category, getNormalizedAssetName(assetFile))
+		asset, found := registry.Lookup(assetName)
+		if !found || !isSidecarOf(asset.path, path) {
 			return
 		}
+		log.Info().Str("assetName", assetName).Msg("Sidecar changed")
+		registry.Add(asset.category, asset.name, asset.path, loadAssetMetadata(asset.path))
+		notifyChanged(assetName)
+		notifyAdded(assetName, asset.path)
+	}
 
-		if err := os.MkdirAll(convertedSoundCachePath, 0700); err != nil {
-			log.Fatal().
-				Err(err).
-				Msg("Failed to create sound cache directory")
+	addPath := func(path string, isDir bool) {
+		category, assetFile, ok := getAssetLocation(assetPath, path, isDir)
+		if !ok {
+			return
 		}
-	}
 
-	for soundName, soundPath := range initialSounds {
-		convertAndCache(soundName, soundPath)
+		if !isDir && isSidecarFile(assetFile) {
+			sidecarChanged(category, assetFile, path)
+		} else if isDir {
+			log.Info().Str("category", category).Msg("Added category")
+			registry.AddCategory(category)
+		} else if category == "" {
+			log.Warn().Str("assetPath", assetPath).Str("assetFile", assetFile).Msg("Unexpected file in category directory")
+		} else {
+			var assetName = getNormalizedAssetName(assetFile)
+			log.Info().Str("assetName", assetName).Msg("Added asset")
+			registry.Add(category, assetName, path, loadAssetMetadata(path))
+			notifyAdded(getQualifiedAssetName(category, assetName), path)
+		}
 	}
-}
 
-func convertAndCache(soundName string, originalSoundPath string) {
-	encodeSession, err := dca.EncodeFile(originalSoundPath, dca.StdEncodeOptions)
-	defer encodeSession.Cleanup()
-
-	var encodedPath = getConvertedSoundCachePath(soundName)
-	// TODO: A leftover cached file could already be present
-	output, err := os.Create(encodedPath)
-	if err != nil {
-		log.Error().
-			Err(err).
-			Str("soundName", soundName).
-			Msg("Failed to cache sound")
-		return
-	}
+	removePath := func(path string, isDir bool) {
+		category, assetFile, ok := getAssetLocation(assetPath, path, isDir)
+		if !ok {
+			return
+		}
 
-	if _, err := io.Copy(output, encodeSession); err != nil {
-		log.Error().
-			Err(err).
-			Str("soundName", soundName).
-			Msg("Failed to copy encoded sound")
-		return
+		if !isDir && isSidecarFile(assetFile) {
+			sidecarChanged(category, assetFile, path)
+		} else if isDir {
+			log.Info().Str("category", category).Msg("Category removed")
+			for _, assetName := range registry.RemoveCategory(category) {
+				notifyChanged(assetName)
+			}
+		} else if category != "" {
+			var assetName = getQualifiedAssetName(category, getNormalizedAssetName(assetFile))
+			// The name may have since been taken over by a file with another extension
+			if asset, found := registry.Lookup(assetName); !found || asset.path != path {
+				return
+			}
+			if _, found := registry.Remove(assetName); found {
+				log.Info().Str("assetName", assetName).Msg("Removed asset")
+				notifyChanged(assetName)
+			}
+		}
 	}
-}
-
-func getConvertedSoundCachePath(soundName string) string {
-	return filepath.Join(convertedSoundCachePath, fmt.Sprintf("%s.dca", soundName))
-}
 
-func isSoundCached(soundName string) bool {
-	var convertedSoundPath = getConvertedSoundCachePath(soundName)
-	var _, err = os.Stat(convertedSoundPath)
-	if os.IsNotExist(err) {
-		return false
-	} else if err != nil {
-		log.Error().
-			Err(err).
-			Str("soundName", soundName).
-			Msg("Error looking up converted sound")
-		return false
-	}
-	return true
+	watchDir(assetPath, func(event watcher.Event) {
+		switch event.Op {
+		case watcher.Create:
+			addPath(event.Path, event.IsDir())
+		case watcher.Remove:
+			removePath(event.Path, event.IsDir())
+		case watcher.Rename, watcher.Move:
+			// Moving a category also moves each of its files, and those events can
+			// come in either order, so both sides are handled independently
+			removePath(event.OldPath, event.IsDir())
+			addPath(event.Path, event.IsDir())
+		case watcher.Write:
+			if event.IsDir() {
+				return
+			}
+			category, assetFile, ok := getAssetLocation(assetPath, event.Path, false)
+			if ok && isSidecarFile(assetFile) {
+				sidecarChanged(category, assetFile, event.Path)
+			} else if ok && category != "" {
+				assetName := getQualifiedAssetName(category, getNormalizedAssetName(assetFile))
+				notifyChanged(assetName)
+				notifyAdded(assetName, event.Path)
+			}
+		}
+	})
 }
 
 func onReady(session *discordgo.Session, event *discordgo.Ready) {
 	log.Info().
 		Msg("Long ago in a distant land...")
 
-	populateInitialVoiceState(session)
+	registerApplicationCommands(session)
 }
 
-func renderPaginatedStrings(title string, allContents []string) func(int) (discordgo.MessageEmbed, error) {
+func renderPaginatedStrings(title string, allContents []string, resultsPerPage int) func(int) (discordgo.MessageEmbed, error) {
 	return func(page int) (discordgo.MessageEmbed, error) {
 		pageStart := page * resultsPerPage
 		pageEnd := (page + 1) * resultsPerPage
@@ -368,7 +410,7 @@ func renderPaginatedStrings(title string, allContents []string) func(int) (disco
 		}
 
 		footer := discordgo.MessageEmbedFooter{
-			Text: fmt.Sprintf("Page %d/%d\n", page+1, totalPages(allContents)),
+			Text: fmt.Sprintf("Page %d/%d\n", page+1, totalPages(allContents, resultsPerPage)),
 		}
 		return discordgo.MessageEmbed{
 			Title:       title,
@@ -378,37 +420,61 @@ func renderPaginatedStrings(title string, allContents []string) func(int) (disco
 	}
 }
 
-func initializeAudioCategoryHelpPage(category string) (helpPage, error) {
-	sounds, categoryFound := audioHelp[category]
+// newPaginatedHelpPage reads the page size once, so a config reload can't
+// change it under a help page that's already been sent
+func newPaginatedHelpPage(name string, title string, entries []string) helpPage {
+	resultsPerPage := getConfig().ResultsPerPage
+	return helpPage{
+		name:       name,
+		page:       0,
+		totalPages: totalPages(entries, resultsPerPage),
+		renderPage: renderPaginatedStrings(title, entries, resultsPerPage),
+	}
+}
+
+// getCategoryBreadcrumb turns a category path into a title showing where it
+// sits in the tree
+func getCategoryBreadcrumb(category string) string {
+	if category == "" {
+		return "Categories"
+	}
+	return "Categories › " + strings.Replace(category, "/", " › ", -1)
+}
+
+func initializeCategoryHelpPage(name string, registry *AssetRegistry, category string) (helpPage, error) {
+	category = strings.Trim(category, "/")
+	assets, categoryFound := registry.ListCategory(category)
 	if !categoryFound {
 		return helpPage{}, errors.New("No such category")
 	}
-	sort.Strings(sounds)
 
-	return helpPage{
-		name:       "audio/" + category,
-		page:       0,
-		totalPages: totalPages(sounds),
-		renderPage: renderPaginatedStrings(category, sounds),
-	}, nil
+	// Subcategories go first, by their full path so they can be typed back in
+	entries := make([]string, 0)
+	for _, subcategory := range registry.Subcategories(category) {
+		entries = append(entries, "📁 "+subcategory)
+	}
+	for _, asset := range assets {
+		entry := asset
+		if registry.Collides(asset) {
+			// Only the qualified name will find this one
+			entry = fmt.Sprintf("%s (%s)", asset, getQualifiedAssetName(category, asset))
+		}
+		if registered, found := registry.Lookup(getQualifiedAssetName(category, asset)); found && registered.metadata.Description != "" {
+			entry += " — " + registered.metadata.Description
+		}
+		entries = append(entries, entry)
+	}
+
+	return newPaginatedHelpPage(name+"/"+category, getCategoryBreadcrumb(category), entries), nil
 }
 
-func initializeCategoryRootHelpPage(name string, index *map[string][]string) (helpPage, error) {
-	categories := make([]string, 0, len(*index))
-	for category := range *index {
-		categories = append(categories, category)
-	}
-	sort.Strings(categories)
+func initializeCategoryRootHelpPage(name string, registry *AssetRegistry) (helpPage, error) {
+	categories := registry.Subcategories("")
 
-	return helpPage{
-		name:       name,
-		page:       0,
-		totalPages: totalPages(categories),
-		renderPage: renderPaginatedStrings("Categories", categories),
-	}, nil
+	return newPaginatedHelpPage(name, getCategoryBreadcrumb(""), categories), nil
 }
 
-func totalPages(allContents []string) int {
+func totalPages(allContents []string, resultsPerPage int) int {
 	return int(math.Ceil(float64(len(allContents)) / float64(resultsPerPage)))
 }
 
@@ -455,7 +521,7 @@ func resetReactions(session *discordgo.Session, channelID string, messageID stri
 	}
 }
 
-func sendHelp(session *discordgo.Session, channelID string, helpPage helpPage) {
+func sendHelp(session *discordgo.Session, responder commandResponder, helpPage helpPage) {
 	messageContent, err := helpPage.renderPage(helpPage.page)
 	if err != nil {
 		log.Info().
@@ -465,26 +531,26 @@ func sendHelp(session *discordgo.Session, channelID string, helpPage helpPage) {
 		return
 	}
 
-	message, err := session.ChannelMessageSendEmbed(channelID, &messageContent)
+	message, err := responder.send(&discordgo.MessageSend{Embeds: []*discordgo.MessageEmbed{&messageContent}})
 	if err != nil {
 		log.Error().
 			Err(err).
-			Str("channelID", channelID).
+			Str("name", helpPage.name).
 			Msg("Error sending help")
 		return
 	}
 
-	initializeReactions(session, channelID, message.ID, paginationReactions)
+	initializeReactions(session, message.ChannelID, message.ID, paginationReactions)
 	activeHelpPages[message.ID] = helpPage
 }
 
-func sendAudioHelp(session *discordgo.Session, channelID string, category string) {
+func sendAudioHelp(session *discordgo.Session, responder commandResponder, category string) {
 	var helpPage helpPage
 	var err error
 	if category == "" {
-		helpPage, err = initializeCategoryRootHelpPage("audio", &audioHelp)
+		helpPage, err = initializeCategoryRootHelpPage("audio", audioAssets)
 	} else {
-		helpPage, err = initializeAudioCategoryHelpPage(category)
+		helpPage, err = initializeCategoryHelpPage("audio", audioAssets, category)
 	}
 	if err != nil {
 		log.Info().
@@ -494,27 +560,44 @@ func sendAudioHelp(session *discordgo.Session, channelID string, category string
 		return
 	}
 
-	sendHelp(session, channelID, helpPage)
+	sendHelp(session, responder, helpPage)
 }
 
-func playSound(session *discordgo.Session, soundName string, soundPath string, authorVoiceState voiceChannelState) {
-	if audioBusy {
-		log.Debug().
-			Msg("Skipping sound because another is being played")
-		return
-	}
+func playSound(session *discordgo.Session, sound registeredAsset, authorVoiceState voiceChannelState, responder commandResponder) {
+	startTime := time.Now()
+	soundName := sound.qualifiedName()
+	soundPath := sound.path
 
-	audioBusy = true
-	defer func() {
-		audioBusy = false
-	}()
+	// The sound counts as playing while it converts, so it can be stopped then
+	source := &stoppableOpusReader{}
+	setActiveStream(authorVoiceState.guild, source)
+	defer setActiveStream(authorVoiceState.guild, nil)
 
-	startTime := time.Now()
-	if !isSoundCached(soundName) {
-		convertAndCache(soundName, soundPath)
+	encodeOptions := getEncodeOptions(sound.metadata, getGuildVolume(authorVoiceState.guild))
+	convertedSoundPath, err := getConvertedSoundCachePath(soundName, soundPath, encodeOptions)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("soundName", soundName).
+			Str("soundPath", soundPath).
+			Msg("Failed to find converted sound")
+		return
+	}
+	if err := ensureConverted(soundName, soundPath, convertedSoundPath, encodeOptions); err != nil {
+		log.Error().
+			Err(err).
+			Str("soundName", soundName).
+			Str("soundPath", soundPath).
+			Msg("Failed to convert sound")
+		return
+	}
+	if source.isStopped() {
+		log.Info().
+			Str("soundName", soundName).
+			Msg("Sound stopped before it played")
+		return
 	}
 
-	var convertedSoundPath = getConvertedSoundCachePath(soundName)
 	assetFile, err := os.Open(convertedSoundPath)
 	defer assetFile.Close()
 	if err != nil {
@@ -536,26 +619,28 @@ func playSound(session *discordgo.Session, soundName string, soundPath string, a
 		return
 	}
 
-	voiceConnection, err := session.ChannelVoiceJoin(
-		authorVoiceState.guild,
-		authorVoiceState.channel,
-		false,
-		false)
-	defer func() {
-		err = voiceConnection.Disconnect()
-		if err != nil {
-			log.Error().
-				Err(err).
-				Str("guild", authorVoiceState.guild).
-				Str("channel", authorVoiceState.channel).
-				Msg("Failed to disconnect from voice")
-		} else {
-			log.Info().
-				Str("guild", authorVoiceState.guild).
-				Str("channel", authorVoiceState.channel).
-				Msg("Disconnected from voice")
-		}
-	}()
+	soundDuration, err := getConvertedSoundDuration(convertedSoundPath)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("soundName", soundName).
+			Str("soundPath", soundPath).
+			Msg("Failed to measure converted sound")
+		return
+	}
+	playbackLimit := getGuildPlaybackLimit(authorVoiceState.guild)
+	if limit := sound.metadata.Limit; limit > 0 {
+		playbackLimit = time.Duration(limit * float64(time.Second))
+	}
+	// Sounds within the limit get some slack in case streaming falls behind
+	streamTimeout := soundDuration + streamTimeoutSlack
+	truncated := soundDuration > playbackLimit
+	if truncated {
+		streamTimeout = playbackLimit
+	}
+
+	voiceConnection, err := acquireVoiceConnection(session, authorVoiceState)
+	defer releaseVoiceConnection(authorVoiceState.guild)
 	if err != nil {
 		log.Error().
 			Err(err).
@@ -566,16 +651,39 @@ func playSound(session *discordgo.Session, soundName string, soundPath string, a
 	}
 
 	done := make(chan error)
-	dca.NewStream(decoder, voiceConnection, done)
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	source.source = decoder
+	dca.NewStream(source, voiceConnection, done)
+	ctx, cancel := context.WithTimeout(context.Background(), streamTimeout)
 	defer cancel()
 	select {
 	case <-ctx.Done():
-		log.Warn().
-			Str("guild", authorVoiceState.guild).
-			Str("channel", authorVoiceState.channel).
-			Msg("Timed out while streaming sound to voice")
-		return
+		// The connection stays open, so the stream has to be ended by hand
+		source.stop()
+		<-done
+		if !truncated {
+			log.Warn().
+				Str("guild", authorVoiceState.guild).
+				Str("channel", authorVoiceState.channel).
+				Msg("Timed out while streaming sound to voice")
+			return
+		}
+		log.Info().
+			Str("soundName", soundName).
+			Dur("soundDuration", soundDuration).
+			Dur("playbackLimit", playbackLimit).
+			Msg("Cut off sound at playback limit")
+		if responder != nil {
+			_, err := responder.send(&discordgo.MessageSend{
+				Content: fmt.Sprintf("✂️ %s is %s long, so it was cut off after %s",
+					soundName, soundDuration.Round(time.Second/10), playbackLimit),
+			})
+			if err != nil {
+				log.Error().
+					Err(err).
+					Str("soundName", soundName).
+					Msg("Error reporting cut off sound")
+			}
+		}
 	case err := <-done:
 		if err != nil && err != io.EOF {
 			log.Error().
@@ -585,8 +693,14 @@ func playSound(session *discordgo.Session, soundName string, soundPath string, a
 				Msg("Streaming decoded sound failed")
 			return
 		}
+		if source.isStopped() {
+			// Stopped or skipped sounds don't count as plays
+			return
+		}
 	}
 
+	recordPlay(soundName)
+
 	duration := time.Since(startTime)
 	log.Debug().
 		Dur("duration", duration).
@@ -601,96 +715,22 @@ func onMessage(session *discordgo.Session, message *discordgo.MessageCreate) {
 		return
 	}
 
+	var prefix = getGuildPrefix(message.GuildID)
 	var command, argument = getCommandFromMessage(message.Content)
-	var authorUsername = getUniqueUsername(message.Author)
-	if !strings.HasPrefix(command, "!aku") {
+	if !strings.HasPrefix(command, prefix+"aku") {
 		return
 	}
 
-	defer func() {
-		err := recover()
-		if err != nil {
-			log.Error().
-				Str("command", command).
-				Msgf("Panic in processing command: %v", err)
-			return
-		}
-	}()
-
-	log.Info().
-		Str("command", command).
-		Str("argument", argument).
-		Str("authorUsername", authorUsername).
-		Msg("Processing command")
-
-	switch command {
-	case "!aku":
-		// Validate we can send
-		var authorVoiceState, authorVoiceStateFound = userVoiceChannel[authorUsername]
-		var assetPath, assetExists = audioAssets[argument]
-		if !authorVoiceStateFound ||
-			authorVoiceState.channel == "" ||
-			!assetExists ||
-			message.GuildID != authorVoiceState.guild {
-			return
-		}
-		playSound(session, argument, assetPath, authorVoiceState)
-
-	case "!akuh":
-		sendAudioHelp(session, message.ChannelID, argument)
-	}
-}
-
-func populateInitialVoiceState(session *discordgo.Session) {
-	userVoiceChannel = make(map[string]voiceChannelState)
-
-	trackedGuilds := 0
-	trackedUsers := 0
-	for _, guild := range session.State.Guilds {
-		// Initially set everyone in the guild to no channel
-		log.Info().
-			Str("guild", guild.ID).
-			Int("members", guild.MemberCount).
-			Msg("Initialized guild")
-		// I'll just pretend that guilds with more than 1000 members don't exist
-		members, err := session.GuildMembers(guild.ID, "", 1000)
-		if err != nil {
-			log.Error().
-				Err(err).
-				Str("guild", guild.ID).
-				Msg("Failed to fetch guild members")
-			continue
-		}
-
-		for _, member := range members {
-			username := getUniqueUsername(member.User)
-			// If we've already seen this person, skip them
-			if _, hasVoiceState := userVoiceChannel[username]; hasVoiceState {
-				continue
-			}
-
-			userVoiceChannel[username] = voiceChannelState{"", guild.ID}
-			trackedUsers++
-		}
-
-		// Voice states only contains people currently in a voice channel
-		for _, voiceState := range guild.VoiceStates {
-			user, err := session.User(voiceState.UserID)
-			if err != nil {
-				continue
-			}
-
-			// If they do have a current voice state, we'll overwrite the blank entry we put before
-			username := getUniqueUsername(user)
-			userVoiceChannel[username] = voiceChannelState{voiceState.ChannelID, voiceState.GuildID}
-		}
-		trackedGuilds++
-	}
-
-	log.Info().
-		Int("trackedUsers", trackedUsers).
-		Int("trackedGuilds", trackedGuilds).
-		Msg("Loaded voice state data")
+	dispatchCommand(commandRequest{
+		session:     session,
+		responder:   &channelResponder{session, message.ChannelID},
+		name:        strings.TrimPrefix(command, prefix),
+		argument:    argument,
+		rawArgument: strings.TrimSpace(strings.TrimPrefix(message.Content, command)),
+		guildID:     message.GuildID,
+		channelID:   message.ChannelID,
+		author:      message.Author,
+	})
 }
 
 func onVoiceStateUpdate(session *discordgo.Session, event *discordgo.VoiceStateUpdate) {
@@ -699,14 +739,15 @@ func onVoiceStateUpdate(session *discordgo.Session, event *discordgo.VoiceStateU
 		return
 	}
 
-	user, err := session.User(event.UserID)
+	user, err := getVoiceStateUser(session, event.VoiceState)
 	if err != nil {
 		log.Debug().
+			Err(err).
 			Msg("Failed to get user from voice state update")
 		return
 	}
 
-	guild, err := session.Guild(event.GuildID)
+	guild, err := getGuild(session, event.GuildID)
 	if err != nil {
 		log.Debug().
 			Str("userID", user.ID).
@@ -715,41 +756,81 @@ func onVoiceStateUpdate(session *discordgo.Session, event *discordgo.VoiceStateU
 	}
 
 	username := getUniqueUsername(user)
-	previousVoiceChannel := userVoiceChannel[username]
+	previousChannel := getPreviousVoiceChannel(event)
 	newVoiceState := voiceChannelState{event.ChannelID, event.GuildID}
-	userVoiceChannel[username] = newVoiceState
 	log.Info().
 		Str("username", username).
 		Str("channelID", event.ChannelID).
 		Str("guildID", event.GuildID).
-		Str("previousChannel", previousVoiceChannel.channel).
-		Str("previousGuild", previousVoiceChannel.guild).
+		Str("previousChannel", previousChannel).
 		Msg("Voice state change")
 
-	entrySoundPath, found := audioAssets[username]
+	if !areEntrySoundsEnabled(event.GuildID) {
+		return
+	}
+	rules := getEntrySoundRules(event.GuildID, user.ID)
+
+	var sound registeredAsset
+	var found bool
+	var soundVoiceState voiceChannelState
+	exiting := false
+	switch getVoiceTransition(previousChannel, newVoiceState.channel, guild.AfkChannelID) {
+	case joinedVoice:
+		sound, found = getEntrySound(event.GuildID, user, rules)
+		soundVoiceState = newVoiceState
+	case movedInVoice:
+		if !rules.playsOnMove() {
+			return
+		}
+		sound, found = getEntrySound(event.GuildID, user, rules)
+		soundVoiceState = newVoiceState
+	case leftVoice:
+		// The exit sound plays for whoever's still there
+		if !rules.playsOnExit() {
+			return
+		}
+		sound, found = getExitSound(event.GuildID, user, rules)
+		soundVoiceState = voiceChannelState{previousChannel, event.GuildID}
+		exiting = true
+	default:
+		return
+	}
 	if !found {
 		log.Info().
 			Str("username", username).
 			Msg("Don't have entry sound for user")
-		// Don't have an entry sound for this user
 		return
 	}
 
-	if newVoiceState.channel != "" && // Don't try to play sounds when the user leaves voice
-		((previousVoiceChannel.channel == "") || // Just joined voice
-			(guild.AfkChannelID != "" && previousVoiceChannel.channel == guild.AfkChannelID) || // Came back from AFK
-			(previousVoiceChannel.guild != event.GuildID)) { // Came from a different guild
+	if rules.isQuietAt(time.Now()) {
 		log.Info().
-			Str("channel", event.ChannelID).
 			Str("guild", event.GuildID).
 			Str("username", username).
-			Msg("Playing entry sound")
-		playSound(session, username, entrySoundPath, newVoiceState)
+			Msg("Skipping entry sound during quiet hours")
+		return
+	}
+	// The cooldown is only there to stop quick rejoins replaying the entry sound
+	if !exiting && !checkEntrySoundCooldown(event.GuildID, user.ID, rules.getCooldown()) {
 		log.Info().
-			Str("channel", event.ChannelID).
 			Str("guild", event.GuildID).
 			Str("username", username).
-			Msg("Played entry sound")
+			Msg("Skipping entry sound during cooldown")
+		return
+	}
+
+	log.Info().
+		Str("channel", soundVoiceState.channel).
+		Str("guild", event.GuildID).
+		Str("username", username).
+		Str("soundName", sound.qualifiedName()).
+		Msg("Queueing entry sound")
+	err = enqueueSound(session, soundRequest{sound, soundVoiceState, nil})
+	if err != nil {
+		log.Warn().
+			Err(err).
+			Str("guild", event.GuildID).
+			Str("username", username).
+			Msg("Failed to queue entry sound")
 	}
 }
 
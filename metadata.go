@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// Sidecar files sit next to an asset with the same name, e.g. bruh.yaml for
+// bruh.mp3, and aren't assets themselves. If an asset has more than one, the
+// first of these is used.
+var sidecarExtensions = []string{".yaml", ".yml", ".json"}
+
+type assetMetadata struct {
+	// Other names the asset can be played by
+	Aliases []string `json:"aliases" yaml:"aliases"`
+	// Shown next to the asset in help
+	Description string `json:"description" yaml:"description"`
+	// Extra words the asset can be searched by
+	Tags []string `json:"tags" yaml:"tags"`
+	// Seconds to trim from the start, and the second to stop at if set
+	Start float64 `json:"start" yaml:"start"`
+	End   float64 `json:"end" yaml:"end"`
+	// Percentage, applied on top of loudness normalization like guild volume
+	Volume int `json:"volume" yaml:"volume"`
+	// Gain in dB applied on top of loudness normalization
+	Gain float64 `json:"gain" yaml:"gain"`
+	// Seconds to play before cutting off, instead of the guild's limit
+	Limit float64 `json:"limit" yaml:"limit"`
+	// Other sounds to pick from when this is someone's entry or exit sound
+	Pool []string `json:"pool" yaml:"pool"`
+}
+
+func isSidecarFile(fileName string) bool {
+	extension := filepath.Ext(fileName)
+	for _, sidecarExtension := range sidecarExtensions {
+		if extension == sidecarExtension {
+			return true
+		}
+	}
+	return false
+}
+
+// isSidecarOf reports whether sidecarPath is one of the sidecar files that
+// could belong to the asset at assetPath
+func isSidecarOf(assetPath string, sidecarPath string) bool {
+	return isSidecarFile(sidecarPath) &&
+		getNormalizedAssetName(assetPath) == getNormalizedAssetName(sidecarPath)
+}
+
+// loadAssetMetadata reads an asset's sidecar file, returning empty metadata
+// if it doesn't have one
+func loadAssetMetadata(assetPath string) assetMetadata {
+	var metadata assetMetadata
+
+	for _, sidecarExtension := range sidecarExtensions {
+		sidecarPath := getNormalizedAssetName(assetPath) + sidecarExtension
+		encoded, err := ioutil.ReadFile(sidecarPath)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			log.Warn().
+				Err(err).
+				Str("sidecarPath", sidecarPath).
+				Msg("Failed to read sidecar")
+			return metadata
+		}
+
+		if sidecarExtension == ".json" {
+			err = json.Unmarshal(encoded, &metadata)
+		} else {
+			err = yaml.Unmarshal(encoded, &metadata)
+		}
+		if err != nil {
+			log.Warn().
+				Err(err).
+				Str("sidecarPath", sidecarPath).
+				Msg("Failed to parse sidecar")
+			return assetMetadata{}
+		}
+		return metadata
+	}
+	return metadata
+}
+
+// getTrimFilter returns the ffmpeg filter cutting a sound down to the part
+// its metadata asks for, or nothing if it's played whole
+func (metadata assetMetadata) getTrimFilter() string {
+	if metadata.Start <= 0 && metadata.End <= 0 {
+		return ""
+	}
+
+	trim := "atrim"
+	separator := "="
+	if metadata.Start > 0 {
+		trim += fmt.Sprintf("%sstart=%.3f", separator, metadata.Start)
+		separator = ":"
+	}
+	if metadata.End > 0 {
+		trim += fmt.Sprintf("%send=%.3f", separator, metadata.End)
+	}
+	// Restart timestamps from zero so the trimmed start isn't played as silence
+	return trim + ",asetpts=PTS-STARTPTS"
+}
+
+// getGain is how much louder or quieter the metadata asks for the asset to
+// be played, in dB
+func (metadata assetMetadata) getGain() float64 {
+	gain := metadata.Gain
+	if metadata.Volume > 0 {
+		gain += percentToDecibels(metadata.Volume)
+	}
+	return gain
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+var playCountsPath string
+
+var playCounts map[string]int
+var playCountsLock sync.Mutex
+
+// Goes up with every play, so anything ordered by play count can tell when
+// it's out of date
+var playCountsVersion int
+
+func loadPlayCounts() {
+	playCountsPath = filepath.Join(rootDir, "playcounts.json")
+	playCounts = make(map[string]int)
+
+	encoded, err := ioutil.ReadFile(playCountsPath)
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Error().
+			Err(err).
+			Str("playCountsPath", playCountsPath).
+			Msg("Failed to read play counts")
+		return
+	}
+
+	if err := json.Unmarshal(encoded, &playCounts); err != nil {
+		log.Error().
+			Err(err).
+			Str("playCountsPath", playCountsPath).
+			Msg("Failed to parse play counts")
+		playCounts = make(map[string]int)
+	}
+}
+
+// getPlayCountsVersion returns the version of the play counts without
+// copying them
+func getPlayCountsVersion() int {
+	playCountsLock.Lock()
+	defer playCountsLock.Unlock()
+
+	return playCountsVersion
+}
+
+// snapshotPlayCounts returns a copy of the play counts and their version
+func snapshotPlayCounts() (map[string]int, int) {
+	playCountsLock.Lock()
+	defer playCountsLock.Unlock()
+
+	snapshot := make(map[string]int, len(playCounts))
+	for soundName, count := range playCounts {
+		snapshot[soundName] = count
+	}
+	return snapshot, playCountsVersion
+}
+
+func recordPlay(soundName string) {
+	playCountsLock.Lock()
+	defer playCountsLock.Unlock()
+
+	playCounts[soundName]++
+	playCountsVersion++
+
+	encoded, err := json.Marshal(playCounts)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Msg("Failed to encode play counts")
+		return
+	}
+
+	if err := writeFileAtomically(playCountsPath, encoded); err != nil {
+		log.Error().
+			Err(err).
+			Str("playCountsPath", playCountsPath).
+			Msg("Failed to save play counts")
+	}
+}
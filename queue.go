@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultMaxQueueDepth = 10
+
+var errQueueFull = errors.New("Queue is full")
+
+type soundRequest struct {
+	sound      registeredAsset
+	voiceState voiceChannelState
+	// Where to tell the requester about the sound, nil for entry sounds
+	responder commandResponder
+}
+
+type guildQueue struct {
+	lock     sync.Mutex
+	pending  []soundRequest
+	current  *soundRequest
+	draining bool
+}
+
+var guildQueues map[string]*guildQueue
+var guildQueuesLock sync.Mutex
+
+func getGuildQueue(guildID string) *guildQueue {
+	guildQueuesLock.Lock()
+	defer guildQueuesLock.Unlock()
+
+	queue, found := guildQueues[guildID]
+	if !found {
+		queue = &guildQueue{pending: make([]soundRequest, 0)}
+		guildQueues[guildID] = queue
+	}
+	return queue
+}
+
+// enqueueSound adds a sound to the back of its guild's queue, and starts
+// playing the queue if nothing is playing in that guild yet
+func enqueueSound(session *discordgo.Session, request soundRequest) error {
+	queue := getGuildQueue(request.voiceState.guild)
+
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	if len(queue.pending) >= getConfig().MaxQueueDepth {
+		return errQueueFull
+	}
+	queue.pending = append(queue.pending, request)
+
+	if !queue.draining {
+		queue.draining = true
+		go drainQueue(session, request.voiceState.guild, queue)
+	}
+
+	log.Debug().
+		Str("guild", request.voiceState.guild).
+		Str("soundName", request.sound.qualifiedName()).
+		Int("depth", len(queue.pending)).
+		Msg("Queued sound")
+	return nil
+}
+
+func drainQueue(session *discordgo.Session, guildID string, queue *guildQueue) {
+	for {
+		queue.lock.Lock()
+		if len(queue.pending) == 0 {
+			queue.current = nil
+			queue.draining = false
+			queue.lock.Unlock()
+			return
+		}
+		request := queue.pending[0]
+		queue.pending = queue.pending[1:]
+		queue.current = &request
+		queue.lock.Unlock()
+
+		playSound(session, request.sound, request.voiceState, request.responder)
+	}
+}
+
+// snapshot returns the sound currently playing (if any) and a copy of the
+// sounds waiting behind it
+func (queue *guildQueue) snapshot() (*soundRequest, []soundRequest) {
+	queue.lock.Lock()
+	defer queue.lock.Unlock()
+
+	var current *soundRequest
+	if queue.current != nil {
+		currentCopy := *queue.current
+		current = &currentCopy
+	}
+	pending := make([]soundRequest, len(queue.pending))
+	copy(pending, queue.pending)
+	return current, pending
+}
+
+func sendQueue(responder commandResponder, guildID string) {
+	current, pending := getGuildQueue(guildID).snapshot()
+
+	messageContent := ""
+	if current == nil && len(pending) == 0 {
+		messageContent = "Nothing is playing"
+	} else {
+		if current != nil {
+			messageContent += fmt.Sprintf("Now playing: %s\n", current.sound.qualifiedName())
+		}
+		for i, request := range pending {
+			messageContent += fmt.Sprintf("%d. %s\n", i+1, request.sound.qualifiedName())
+		}
+	}
+
+	footer := discordgo.MessageEmbedFooter{
+		Text: fmt.Sprintf("%d/%d queued\n", len(pending), getConfig().MaxQueueDepth),
+	}
+	_, err := responder.send(&discordgo.MessageSend{Embeds: []*discordgo.MessageEmbed{{
+		Title:       "Queue",
+		Description: messageContent,
+		Footer:      &footer,
+	}}})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("guildID", guildID).
+			Msg("Error sending queue")
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+// A random pick avoids this many of the guild's previous random picks, so
+// the same sound doesn't come up again right away
+const defaultRandomRepeatWindow = 5
+
+// Most recent last, keyed by guild ID
+var recentRandomSounds map[string][]string
+var recentRandomSoundsLock sync.Mutex
+
+// pickRandomSound picks a sound from a category and its subcategories, or
+// from every sound if category is empty, skipping ones picked recently in
+// the guild
+func pickRandomSound(guildID string, category string) (registeredAsset, bool) {
+	category = strings.Trim(category, "/")
+	candidates := make([]string, 0)
+	for qualifiedName := range audioAssets.AllPaths() {
+		if category == "" || strings.HasPrefix(qualifiedName, category+"/") {
+			candidates = append(candidates, qualifiedName)
+		}
+	}
+	if len(candidates) == 0 {
+		return registeredAsset{}, false
+	}
+
+	recentRandomSoundsLock.Lock()
+	defer recentRandomSoundsLock.Unlock()
+
+	// Small categories can't avoid every recent pick, so only the most recent
+	// ones are avoided
+	window := minInt(getConfig().RandomRepeatWindow, len(candidates)-1)
+	recent := recentRandomSounds[guildID]
+	if len(recent) > window {
+		recent = recent[len(recent)-window:]
+	}
+
+	eligible := make([]string, 0, len(candidates))
+	for _, candidate := range candidates {
+		if !containsString(recent, candidate) {
+			eligible = append(eligible, candidate)
+		}
+	}
+	if len(eligible) == 0 {
+		eligible = candidates
+	}
+
+	picked := eligible[rand.Intn(len(eligible))]
+	recentRandomSounds[guildID] = append(recent, picked)
+	return audioAssets.Lookup(picked)
+}
+
+func containsString(values []string, value string) bool {
+	for _, existing := range values {
+		if existing == value {
+			return true
+		}
+	}
+	return false
+}
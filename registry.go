@@ -0,0 +1,314 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+type registeredAsset struct {
+	name     string
+	category string
+	path     string
+	metadata assetMetadata
+}
+
+// qualifiedName is the asset's name prefixed by its category (e.g.
+// memes/bruh), which is unique even when the bare name isn't
+func (asset registeredAsset) qualifiedName() string {
+	return getQualifiedAssetName(asset.category, asset.name)
+}
+
+func getQualifiedAssetName(category string, name string) string {
+	return category + "/" + name
+}
+
+// AssetRegistry indexes asset files by name and by category. It's shared
+// between the directory watchers and the Discord event handlers, so
+// everything it hands out is a copy.
+type AssetRegistry struct {
+	lock sync.RWMutex
+	// Keyed by qualified name
+	assets map[string]registeredAsset
+	// Bare name to the qualified names of every asset using it
+	names map[string][]string
+	// Category to the bare names of the assets in it
+	categories map[string][]string
+	// Alias to the qualified names of every asset using it
+	aliases map[string][]string
+}
+
+func NewAssetRegistry() *AssetRegistry {
+	return &AssetRegistry{
+		assets:     make(map[string]registeredAsset),
+		names:      make(map[string][]string),
+		categories: make(map[string][]string),
+		aliases:    make(map[string][]string),
+	}
+}
+
+func (registry *AssetRegistry) AddCategory(category string) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	if _, found := registry.categories[category]; !found {
+		registry.categories[category] = make([]string, 0)
+	}
+}
+
+// RemoveCategory drops the category, its subcategories and every asset in
+// them, returning the qualified names of the removed assets
+func (registry *AssetRegistry) RemoveCategory(category string) []string {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	removed := make([]string, 0)
+	for existingCategory, categoryNames := range registry.categories {
+		if existingCategory != category && !strings.HasPrefix(existingCategory, category+"/") {
+			continue
+		}
+		for _, name := range categoryNames {
+			qualifiedName := getQualifiedAssetName(existingCategory, name)
+			registry.removeLocked(qualifiedName)
+			removed = append(removed, qualifiedName)
+		}
+		delete(registry.categories, existingCategory)
+	}
+	return removed
+}
+
+// Add registers an asset under a category. Assets sharing a bare name with
+// one in another category are kept, but warned about since they can then only
+// be reached by their qualified name.
+func (registry *AssetRegistry) Add(category string, name string, path string, metadata assetMetadata) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	asset := registeredAsset{name, category, path, metadata}
+	qualifiedName := asset.qualifiedName()
+
+	if existing, found := registry.assets[qualifiedName]; found && existing.path != path {
+		// Same name with a different extension in the same category
+		log.Warn().
+			Str("assetName", qualifiedName).
+			Str("path", path).
+			Str("replacedPath", existing.path).
+			Msg("Duplicate asset name within category, replacing")
+	}
+	registry.removeLocked(qualifiedName)
+
+	for _, collidingName := range registry.names[name] {
+		log.Warn().
+			Str("assetName", name).
+			Str("path", path).
+			Str("collidingPath", registry.assets[collidingName].path).
+			Msg("Duplicate asset name across categories, use the category to pick one")
+	}
+
+	registry.insertLocked(asset)
+}
+
+func (registry *AssetRegistry) insertLocked(asset registeredAsset) {
+	qualifiedName := asset.qualifiedName()
+	registry.assets[qualifiedName] = asset
+	registry.names[asset.name] = append(registry.names[asset.name], qualifiedName)
+	registry.categories[asset.category] = append(registry.categories[asset.category], asset.name)
+	for _, alias := range asset.metadata.Aliases {
+		registry.aliases[alias] = append(registry.aliases[alias], qualifiedName)
+	}
+}
+
+// Remove unregisters an asset by its qualified name, returning the path it had
+func (registry *AssetRegistry) Remove(qualifiedName string) (string, bool) {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+
+	return registry.removeLocked(qualifiedName)
+}
+
+// removeWithout returns a copy of names without the first instance of name,
+// so that copies handed out earlier aren't disturbed
+func removeWithout(names []string, name string) []string {
+	remaining := make([]string, 0, len(names))
+	for i, existingName := range names {
+		if existingName == name {
+			return append(remaining, names[i+1:]...)
+		}
+		remaining = append(remaining, existingName)
+	}
+	return remaining
+}
+
+func (registry *AssetRegistry) removeLocked(qualifiedName string) (string, bool) {
+	asset, found := registry.assets[qualifiedName]
+	if !found {
+		return "", false
+	}
+	delete(registry.assets, qualifiedName)
+
+	registry.names[asset.name] = removeWithout(registry.names[asset.name], qualifiedName)
+	if len(registry.names[asset.name]) == 0 {
+		delete(registry.names, asset.name)
+	}
+	if categoryNames, found := registry.categories[asset.category]; found {
+		registry.categories[asset.category] = removeWithout(categoryNames, asset.name)
+	}
+	for _, alias := range asset.metadata.Aliases {
+		registry.aliases[alias] = removeWithout(registry.aliases[alias], qualifiedName)
+		if len(registry.aliases[alias]) == 0 {
+			delete(registry.aliases, alias)
+		}
+	}
+	return asset.path, true
+}
+
+// Lookup finds an asset by its qualified name, or by its bare name or an
+// alias as long as no other asset has the same one. Names take precedence
+// over aliases.
+func (registry *AssetRegistry) Lookup(name string) (registeredAsset, bool) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	if asset, found := registry.assets[name]; found {
+		return asset, true
+	}
+	qualifiedNames, found := registry.names[name]
+	if !found {
+		qualifiedNames = registry.aliases[name]
+	}
+	if len(qualifiedNames) != 1 {
+		return registeredAsset{}, false
+	}
+	return registry.assets[qualifiedNames[0]], true
+}
+
+// Qualify returns the sorted qualified names of every asset with a bare name
+func (registry *AssetRegistry) Qualify(name string) []string {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	qualifiedNames := make([]string, len(registry.names[name]))
+	copy(qualifiedNames, registry.names[name])
+	sort.Strings(qualifiedNames)
+	return qualifiedNames
+}
+
+// Collides reports whether more than one category has an asset with this name
+func (registry *AssetRegistry) Collides(name string) bool {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	return len(registry.names[name]) > 1
+}
+
+// ListCategory returns the sorted names of the assets in a category
+func (registry *AssetRegistry) ListCategory(category string) ([]string, bool) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	names, found := registry.categories[category]
+	if !found {
+		return nil, false
+	}
+	sortedNames := make([]string, len(names))
+	copy(sortedNames, names)
+	sort.Strings(sortedNames)
+	return sortedNames, true
+}
+
+// Categories returns the sorted paths of every category
+func (registry *AssetRegistry) Categories() []string {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	categories := make([]string, 0, len(registry.categories))
+	for category := range registry.categories {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+// Subcategories returns the sorted paths of the categories directly inside
+// parent, or the top level categories if parent is empty
+func (registry *AssetRegistry) Subcategories(parent string) []string {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	subcategories := make([]string, 0)
+	for category := range registry.categories {
+		categoryParent := path.Dir(category)
+		if categoryParent == "." {
+			categoryParent = ""
+		}
+		if categoryParent == parent {
+			subcategories = append(subcategories, category)
+		}
+	}
+	sort.Strings(subcategories)
+	return subcategories
+}
+
+// Names returns the name every asset can be looked up by, which is the bare
+// name unless it collides with another category's, in no particular order
+func (registry *AssetRegistry) Names() []string {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	names := make([]string, 0, len(registry.assets))
+	for name, qualifiedNames := range registry.names {
+		if len(qualifiedNames) == 1 {
+			names = append(names, name)
+		} else {
+			names = append(names, qualifiedNames...)
+		}
+	}
+	return names
+}
+
+// Assets returns every asset, in no particular order
+func (registry *AssetRegistry) Assets() []registeredAsset {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	assets := make([]registeredAsset, 0, len(registry.assets))
+	for _, asset := range registry.assets {
+		assets = append(assets, asset)
+	}
+	return assets
+}
+
+// Paths returns the paths of every asset in a category, keyed by qualified name
+func (registry *AssetRegistry) Paths(category string) map[string]string {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	paths := make(map[string]string)
+	for _, name := range registry.categories[category] {
+		asset := registry.assets[getQualifiedAssetName(category, name)]
+		paths[asset.qualifiedName()] = asset.path
+	}
+	return paths
+}
+
+// AllPaths returns the paths of every asset, keyed by qualified name
+func (registry *AssetRegistry) AllPaths() map[string]string {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	paths := make(map[string]string)
+	for qualifiedName, asset := range registry.assets {
+		paths[qualifiedName] = asset.path
+	}
+	return paths
+}
+
+func (registry *AssetRegistry) Len() (int, int) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+
+	return len(registry.categories), len(registry.assets)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Matching a tag or category says less about a result than matching its name
+const secondaryMatchDivisor = 2
+
+type searchResult struct {
+	entry string
+	score int
+}
+
+// getSearchScore is the best score of a query against an asset's name and
+// aliases, or against its tags and category at a discount
+func getSearchScore(query string, asset registeredAsset) int {
+	score := getFuzzyScore(query, asset.name)
+	for _, alias := range asset.metadata.Aliases {
+		score = maxInt(score, getFuzzyScore(query, alias))
+	}
+
+	secondaryScore := 0
+	for _, tag := range asset.metadata.Tags {
+		secondaryScore = maxInt(secondaryScore, getFuzzyScore(query, getAssetFromCommand(tag)))
+	}
+	for _, categoryPart := range strings.Split(asset.category, "/") {
+		secondaryScore = maxInt(secondaryScore, getFuzzyScore(query, categoryPart))
+	}
+	return maxInt(score, secondaryScore/secondaryMatchDivisor)
+}
+
+func maxInt(first int, rest ...int) int {
+	max := first
+	for _, value := range rest {
+		if value > max {
+			max = value
+		}
+	}
+	return max
+}
+
+// searchAssets ranks every asset and category matching the query, best first.
+// Assets are listed by the name they can be looked up with, followed by their
+// category.
+func searchAssets(registry *AssetRegistry, query string) []string {
+	results := make([]searchResult, 0)
+
+	for _, category := range registry.Categories() {
+		score := getFuzzyScore(query, category)
+		for _, categoryPart := range strings.Split(category, "/") {
+			score = maxInt(score, getFuzzyScore(query, categoryPart))
+		}
+		if score > 0 {
+			results = append(results, searchResult{"📁 " + category, score})
+		}
+	}
+
+	for _, asset := range registry.Assets() {
+		score := getSearchScore(query, asset)
+		if score == 0 {
+			continue
+		}
+
+		entry := asset.name
+		if registry.Collides(asset.name) {
+			entry = asset.qualifiedName()
+		}
+		if asset.category != "" {
+			entry += fmt.Sprintf(" (📁 %s)", asset.category)
+		}
+		results = append(results, searchResult{entry, score})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].score != results[j].score {
+			return results[i].score > results[j].score
+		}
+		return results[i].entry < results[j].entry
+	})
+
+	entries := make([]string, len(results))
+	for i, result := range results {
+		entries[i] = result.entry
+	}
+	return entries
+}
+
+func initializeSearchHelpPage(name string, registry *AssetRegistry, query string) (helpPage, error) {
+	entries := searchAssets(registry, query)
+	if len(entries) == 0 {
+		return helpPage{}, errors.New("No search results")
+	}
+
+	return newPaginatedHelpPage(name+"/search/"+query, "Search › "+query, entries), nil
+}
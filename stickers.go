@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+)
+
+func sendSticker(responder commandResponder, stickerName string, stickerPath string) {
+	stickerFile, err := os.Open(stickerPath)
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("stickerName", stickerName).
+			Str("stickerPath", stickerPath).
+			Msg("Failed to open sticker")
+		return
+	}
+	defer stickerFile.Close()
+
+	// Discord decides whether to inline the image from the attachment's extension
+	_, err = responder.send(&discordgo.MessageSend{
+		Files: []*discordgo.File{{
+			Name:   filepath.Base(stickerPath),
+			Reader: stickerFile,
+		}},
+	})
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("stickerName", stickerName).
+			Msg("Failed to send sticker")
+	}
+}
+
+func sendStickerHelp(session *discordgo.Session, responder commandResponder, category string) {
+	var helpPage helpPage
+	var err error
+	if category == "" {
+		helpPage, err = initializeCategoryRootHelpPage("sticker", stickerAssets)
+	} else {
+		helpPage, err = initializeCategoryHelpPage("sticker", stickerAssets, category)
+	}
+	if err != nil {
+		log.Info().
+			Err(err).
+			Str("category", category).
+			Msg("Error initializing sticker help page")
+		return
+	}
+
+	sendHelp(session, responder, helpPage)
+}
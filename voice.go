@@ -0,0 +1,218 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/jonas747/dca"
+	"github.com/rs/zerolog/log"
+)
+
+const defaultVoiceIdleTimeoutSeconds = 300
+
+// How long past a sound's duration to wait for it to finish streaming
+const streamTimeoutSlack = 5 * time.Second
+
+type guildVoice struct {
+	lock       sync.Mutex
+	connection *discordgo.VoiceConnection
+	busy       bool
+	idleTimer  *time.Timer
+	// What's being streamed right now, if anything
+	stream *stoppableOpusReader
+}
+
+var guildVoices map[string]*guildVoice
+var guildVoicesLock sync.Mutex
+
+// stoppableOpusReader lets a dca stream be ended early by reporting EOF once
+// stopped. It's made before the sound is converted, so a sound can be stopped
+// before it starts, and its source is set once there's one to read.
+type stoppableOpusReader struct {
+	source  dca.OpusReader
+	stopped int32
+}
+
+func (reader *stoppableOpusReader) OpusFrame() ([]byte, error) {
+	if reader.isStopped() {
+		return nil, io.EOF
+	}
+	return reader.source.OpusFrame()
+}
+
+func (reader *stoppableOpusReader) FrameDuration() time.Duration {
+	return reader.source.FrameDuration()
+}
+
+func (reader *stoppableOpusReader) stop() {
+	atomic.StoreInt32(&reader.stopped, 1)
+}
+
+func (reader *stoppableOpusReader) isStopped() bool {
+	return atomic.LoadInt32(&reader.stopped) != 0
+}
+
+func getGuildVoice(guildID string) *guildVoice {
+	guildVoicesLock.Lock()
+	defer guildVoicesLock.Unlock()
+
+	voice, found := guildVoices[guildID]
+	if !found {
+		voice = &guildVoice{}
+		guildVoices[guildID] = voice
+	}
+	return voice
+}
+
+func isConnectedTo(connection *discordgo.VoiceConnection, channelID string) bool {
+	if connection == nil {
+		return false
+	}
+	connection.RLock()
+	defer connection.RUnlock()
+	return connection.Ready && connection.ChannelID == channelID
+}
+
+// acquireVoiceConnection returns a voice connection to the requested channel,
+// reusing the guild's open connection if there is one and moving it if the
+// requester is somewhere else. It must be paired with releaseVoiceConnection.
+func acquireVoiceConnection(session *discordgo.Session, voiceState voiceChannelState) (*discordgo.VoiceConnection, error) {
+	voice := getGuildVoice(voiceState.guild)
+
+	voice.lock.Lock()
+	defer voice.lock.Unlock()
+
+	voice.busy = true
+	if voice.idleTimer != nil {
+		voice.idleTimer.Stop()
+		voice.idleTimer = nil
+	}
+
+	if isConnectedTo(voice.connection, voiceState.channel) {
+		return voice.connection, nil
+	}
+
+	// ChannelVoiceJoin moves an existing connection for the guild if there is one
+	connection, err := session.ChannelVoiceJoin(voiceState.guild, voiceState.channel, false, false)
+	if err != nil {
+		voice.connection = nil
+		return nil, err
+	}
+
+	log.Info().
+		Str("guild", voiceState.guild).
+		Str("channel", voiceState.channel).
+		Msg("Joined voice")
+	voice.connection = connection
+	return connection, nil
+}
+
+// releaseVoiceConnection marks the guild's connection as idle, and schedules
+// a disconnect if nothing else acquires it before the idle timeout
+func releaseVoiceConnection(guildID string) {
+	voice := getGuildVoice(guildID)
+
+	voice.lock.Lock()
+	defer voice.lock.Unlock()
+
+	voice.busy = false
+	if voice.connection == nil {
+		return
+	}
+
+	var idleTimer *time.Timer
+	voiceIdleTimeout := time.Duration(getConfig().VoiceIdleTimeoutSeconds) * time.Second
+	idleTimer = time.AfterFunc(voiceIdleTimeout, func() {
+		voice.lock.Lock()
+		defer voice.lock.Unlock()
+
+		// Someone picked the connection back up after this timer fired
+		if voice.busy || voice.idleTimer != idleTimer {
+			return
+		}
+		voice.idleTimer = nil
+		disconnectVoice(guildID, voice)
+	})
+	voice.idleTimer = idleTimer
+}
+
+// setActiveStream records what the guild is streaming so it can be stopped,
+// or clears it when stream is nil
+func setActiveStream(guildID string, stream *stoppableOpusReader) {
+	voice := getGuildVoice(guildID)
+
+	voice.lock.Lock()
+	defer voice.lock.Unlock()
+
+	voice.stream = stream
+}
+
+// stopActiveStream ends whatever the guild is streaming, returning false if
+// it wasn't streaming anything
+func stopActiveStream(guildID string) bool {
+	voice := getGuildVoice(guildID)
+
+	voice.lock.Lock()
+	defer voice.lock.Unlock()
+
+	if voice.stream == nil {
+		return false
+	}
+	voice.stream.stop()
+	voice.stream = nil
+	return true
+}
+
+// getConnectedChannel returns the voice channel the bot is in for a guild, or
+// nothing if it isn't in one
+func getConnectedChannel(guildID string) string {
+	voice := getGuildVoice(guildID)
+
+	voice.lock.Lock()
+	defer voice.lock.Unlock()
+
+	if voice.connection == nil {
+		return ""
+	}
+	voice.connection.RLock()
+	defer voice.connection.RUnlock()
+	return voice.connection.ChannelID
+}
+
+// disconnectVoice must be called with the guild's voice lock held
+func disconnectVoice(guildID string, voice *guildVoice) {
+	if voice.connection == nil {
+		return
+	}
+
+	err := voice.connection.Disconnect()
+	if err != nil {
+		log.Error().
+			Err(err).
+			Str("guild", guildID).
+			Msg("Failed to disconnect from voice")
+	} else {
+		log.Info().
+			Str("guild", guildID).
+			Msg("Disconnected from voice")
+	}
+	voice.connection = nil
+}
+
+func disconnectAllVoice() {
+	guildVoicesLock.Lock()
+	defer guildVoicesLock.Unlock()
+
+	for guildID, voice := range guildVoices {
+		voice.lock.Lock()
+		if voice.idleTimer != nil {
+			voice.idleTimer.Stop()
+			voice.idleTimer = nil
+		}
+		disconnectVoice(guildID, voice)
+		voice.lock.Unlock()
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// getUserVoiceState returns the voice channel a user is in within a guild.
+// discordgo's state cache tracks every guild's voice states from the gateway,
+// so there's nothing to ask Discord for when it has none for the user.
+func getUserVoiceState(session *discordgo.Session, guildID string, userID string) (voiceChannelState, bool) {
+	voiceState, err := session.State.VoiceState(guildID, userID)
+	if err != nil || voiceState.ChannelID == "" {
+		return voiceChannelState{}, false
+	}
+	return voiceChannelState{voiceState.ChannelID, guildID}, true
+}
+
+// getPreviousVoiceChannel returns the channel a user was in before a voice
+// state update, which the state cache fills in before handlers see it
+func getPreviousVoiceChannel(event *discordgo.VoiceStateUpdate) string {
+	if event.BeforeUpdate == nil {
+		return ""
+	}
+	return event.BeforeUpdate.ChannelID
+}
+
+type voiceTransition int
+
+const (
+	// Muting, deafening, going AFK and anything else that gets no sound
+	noVoiceTransition voiceTransition = iota
+	joinedVoice
+	movedInVoice
+	leftVoice
+)
+
+// getVoiceTransition works out what a voice state change means for entry
+// sounds. The AFK channel counts as being out of voice, so coming back from
+// it is a join, while going to it or leaving voice from it is nothing since
+// nobody would hear a sound there.
+func getVoiceTransition(previousChannel string, newChannel string, afkChannel string) voiceTransition {
+	isInVoice := func(channel string) bool {
+		return channel != "" && channel != afkChannel
+	}
+
+	switch {
+	case !isInVoice(previousChannel) && isInVoice(newChannel):
+		return joinedVoice
+	case !isInVoice(previousChannel):
+		return noVoiceTransition
+	case newChannel == "":
+		return leftVoice
+	case isInVoice(newChannel) && newChannel != previousChannel:
+		return movedInVoice
+	}
+	return noVoiceTransition
+}
+
+// getVoiceStateUser finds who a voice state belongs to, from the state cache
+// if possible. Voice state updates within a guild come with the member.
+func getVoiceStateUser(session *discordgo.Session, voiceState *discordgo.VoiceState) (*discordgo.User, error) {
+	if voiceState.Member != nil && voiceState.Member.User != nil {
+		return voiceState.Member.User, nil
+	}
+	if member, err := session.State.Member(voiceState.GuildID, voiceState.UserID); err == nil && member.User != nil {
+		return member.User, nil
+	}
+	return session.User(voiceState.UserID)
+}
+
+// getGuild returns a guild from the state cache, only asking Discord if it
+// isn't cached
+func getGuild(session *discordgo.Session, guildID string) (*discordgo.Guild, error) {
+	if guild, err := session.State.Guild(guildID); err == nil {
+		return guild, nil
+	}
+	return session.Guild(guildID)
+}
@@ -0,0 +1,35 @@
+package main
+
+import "testing"
+
+func TestGetVoiceTransition(t *testing.T) {
+	const afk = "afk"
+
+	tests := []struct {
+		name            string
+		previousChannel string
+		newChannel      string
+		afkChannel      string
+		transition      voiceTransition
+	}{
+		{"join", "", "general", afk, joinedVoice},
+		{"join without AFK channel", "", "general", "", joinedVoice},
+		{"mute", "general", "general", afk, noVoiceTransition},
+		{"move", "general", "gaming", afk, movedInVoice},
+		{"leave", "general", "", afk, leftVoice},
+		{"leave without AFK channel", "general", "", "", leftVoice},
+		{"go AFK", "general", afk, afk, noVoiceTransition},
+		{"come back from AFK", afk, "general", afk, joinedVoice},
+		{"leave from AFK", afk, "", afk, noVoiceTransition},
+		{"join straight into AFK", "", afk, afk, noVoiceTransition},
+		{"nothing to nothing", "", "", afk, noVoiceTransition},
+	}
+
+	for _, test := range tests {
+		transition := getVoiceTransition(test.previousChannel, test.newChannel, test.afkChannel)
+		if transition != test.transition {
+			t.Errorf("%s: getVoiceTransition(%q, %q, %q) = %d, want %d",
+				test.name, test.previousChannel, test.newChannel, test.afkChannel, transition, test.transition)
+		}
+	}
+}